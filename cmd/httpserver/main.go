@@ -1,25 +1,86 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"fmt"
+	"httpfromtcp/internal/fileserver"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/middleware"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/router"
 	"httpfromtcp/internal/server"
+	"io"
+	"io/fs"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 const port = 42069
 
+const shutdownTimeout = 10 * time.Second
+
+//go:embed static
+var static embed.FS
+
 func main() {
 
-	server, err := server.Serve(port, func(w *response.Writer, req *request.Request) *server.HandlerError {
+	rt := router.New()
+	rt.Get("/yourproblem", yourProblem)
+	rt.Get("/myproblem", myProblem)
+	rt.Get("/httpbin/{path...}", func(w *response.Writer, req *request.Request) *server.HandlerError {
+		path := req.PathValue("path")
+		if req.RequestLine.RawQuery != "" {
+			path += "?" + req.RequestLine.RawQuery
+		}
+		return proxyHttpbin(req.Context(), w, path)
+	})
+
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		log.Fatalf("Error loading static files: %v", err)
+	}
+	rt.Get("/{path...}", fileserver.New(files).ServeRequest)
+
+	handler := server.Chain(rt.ServeRequest,
+		middleware.RequestID,
+		middleware.Logging,
+		middleware.Recover,
+	)
 
-		log.Println(req.RequestLine.RequestTarget)
-		if req.RequestLine.RequestTarget == "/yourproblem" {
-			return &server.HandlerError{
-				Message: `
+	server, err := server.ServeConfig(port, handler, server.Config{
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		ServerHeader:      "httpfromtcp",
+	})
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	log.Println("Server started on port", port)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown timed out, closed remaining connections: %v\n", err)
+	}
+	log.Println("Server gracefully stopped")
+}
+
+func yourProblem(w *response.Writer, req *request.Request) *server.HandlerError {
+	return &server.HandlerError{
+		Message: `
 <html>
   <head>
     <title>400 Bad Request</title>
@@ -29,12 +90,14 @@ func main() {
     <p>Your request honestly kinda sucked.</p>
   </body>
 </html>`,
-				ContentType: "text/html",
-				StatusCode:  response.StatusBadRequest,
-			}
-		} else if req.RequestLine.RequestTarget == "/myproblem" {
-			return &server.HandlerError{
-				Message: `
+		ContentType: "text/html",
+		StatusCode:  response.StatusBadRequest,
+	}
+}
+
+func myProblem(w *response.Writer, req *request.Request) *server.HandlerError {
+	return &server.HandlerError{
+		Message: `
 <html>
   <head>
     <title>500 Internal Server Error</title>
@@ -45,37 +108,77 @@ func main() {
   </body>
 </html>
 				`,
-				ContentType: "text/html",
-				StatusCode:  response.StatusInternalServerError,
-			}
-		} else {
-			w.WriteStatusLine(response.StatusOK)
-			body := []byte(`
-<html>
-  <head>
-    <title>200 OK</title>
-  </head>
-  <body>
-    <h1>Success!</h1>
-    <p>Your request was an absolute banger.</p>
-  </body>
-</html>`)
-			headers := response.GetDefaultHeaders(len(body))
-			headers.Override("Content-Type", "text/html")
-			w.WriteHeaders(headers)
-			w.WriteBody(body)
+		ContentType: "text/html",
+		StatusCode:  response.StatusInternalServerError,
+	}
+}
+
+// proxyHttpbin streams the httpbin.org response for path back to the client
+// as a chunked body, flushing every chunk as it arrives, and sends the hash
+// and length of the full body as trailers. The upstream request is abandoned
+// when ctx ends, e.g. once the client goes away.
+func proxyHttpbin(ctx context.Context, w *response.Writer, path string) *server.HandlerError {
+	upstream, err := http.NewRequestWithContext(ctx, "GET", "https://httpbin.org/"+path, nil)
+	if err != nil {
+		return &server.HandlerError{
+			Message:     err.Error(),
+			ContentType: "text/plain",
+			StatusCode:  response.StatusBadRequest,
 		}
+	}
 
-		return nil
-	})
+	res, err := http.DefaultClient.Do(upstream)
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		return &server.HandlerError{
+			Message:     err.Error(),
+			ContentType: "text/plain",
+			StatusCode:  response.StatusInternalServerError,
+		}
 	}
-	defer server.Close()
-	log.Println("Server started on port", port)
+	defer res.Body.Close()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	log.Println("Server gracefully stopped")
+	w.WriteStatusLine(response.StatusOK)
+	h := headers.NewHeaders()
+	if contentType := res.Header.Get("Content-Type"); contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Content-SHA256, X-Content-Length")
+	w.WriteHeaders(h)
+
+	hash := sha256.New()
+	total := 0
+	buf := make([]byte, 1024)
+
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			total += n
+			w.WriteChunkedBody(buf[:n])
+			if err := w.Flush(); err != nil {
+				return nil
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			// Ending the body normally would pass off what was
+			// received as the whole of it.
+			log.Printf("Error reading from httpbin: %v\n", err)
+			w.Abort()
+			return nil
+		}
+	}
+
+	w.WriteChunkedBodyDone()
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", hash.Sum(nil)))
+	trailers.Set("X-Content-Length", fmt.Sprintf("%d", total))
+	w.WriteTrailers(trailers)
+
+	return nil
 }
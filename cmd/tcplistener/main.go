@@ -81,9 +81,10 @@ func main() {
 
 		fmt.Println("Headers:")
 
-		for k, v := range request.Headers {
-			fmt.Printf("- %s: %s\n", k, v)
-		}
+		request.Headers.Range(func(name string, value string) bool {
+			fmt.Printf("- %s: %s\n", name, value)
+			return true
+		})
 
 		fmt.Println("Body:")
 		fmt.Printf("%s\n", request.Body)
@@ -0,0 +1,365 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// sniffLen is how much of a file is looked at to guess its type when its
+// extension doesn't tell.
+const sniffLen = 512
+
+// blockSize is how much of a file is read and sent at a time.
+const blockSize = 32 * 1024
+
+// FileServer serves the files of a file system, such as a directory or an
+// embed.FS. Files are looked up by the canonical Request.Path, whose "." and
+// ".." segments are already resolved, and any name that is still not a valid
+// fs.FS path is refused, so requests can't reach outside the file system.
+// Symbolic links inside a directory are followed.
+//
+// A directory is served through its index.html, or listed if ListDirectories
+// is set.
+type FileServer struct {
+	// Prefix is removed from the request path before looking up the file,
+	// for a file server mounted under a route such as "/static/{path...}".
+	Prefix string
+	// ListDirectories answers requests for directories without an
+	// index.html with a listing of their entries, instead of a 404.
+	ListDirectories bool
+
+	fsys fs.FS
+}
+
+func New(fsys fs.FS) *FileServer {
+	return &FileServer{fsys: fsys}
+}
+
+// Dir returns a FileServer for the directory dir of the operating system.
+func Dir(dir string) *FileServer {
+	return New(os.DirFS(dir))
+}
+
+// ServeRequest has the signature of a server.Handler, so the file server can
+// be passed to a router or to server.Serve as fsrv.ServeRequest.
+func (fsrv *FileServer) ServeRequest(w *response.Writer, req *request.Request) *server.HandlerError {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		body := []byte("Method Not Allowed\n")
+
+		w.WriteStatusLine(response.StatusMethodNotAllowed)
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("Allow", "GET, HEAD")
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+		return nil
+	}
+
+	name, ok := fsrv.name(req.Path)
+	if !ok {
+		return notFound()
+	}
+
+	info, err := fs.Stat(fsrv.fsys, name)
+	if err != nil {
+		return statError(err)
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(req.Path, "/") {
+			// Relative links in the index or listing only resolve
+			// against a path that ends with a slash.
+			return redirect(w, req, req.Path+"/")
+		}
+
+		index := path.Join(name, "index.html")
+		if indexInfo, err := fs.Stat(fsrv.fsys, index); err == nil && indexInfo.Mode().IsRegular() {
+			return fsrv.serveFile(w, req, index, indexInfo)
+		}
+
+		if !fsrv.ListDirectories {
+			return notFound()
+		}
+
+		return fsrv.serveListing(w, req, name)
+	}
+
+	if !info.Mode().IsRegular() {
+		return notFound()
+	}
+
+	return fsrv.serveFile(w, req, name, info)
+}
+
+// name turns a request path into a name in the file system, reporting false
+// if the path is outside Prefix or not a valid name.
+func (fsrv *FileServer) name(requestPath string) (string, bool) {
+	prefix := strings.TrimSuffix(fsrv.Prefix, "/")
+	if prefix != "" {
+		rest, ok := strings.CutPrefix(requestPath, prefix)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			return "", false
+		}
+		requestPath = rest
+	}
+
+	name := strings.Trim(requestPath, "/")
+	if name == "" {
+		return ".", true
+	}
+
+	// Backslashes and NULs are separators or terminators on some systems,
+	// where they could be used to get around the checks of fs.ValidPath.
+	if strings.ContainsAny(name, "\\\x00") || !fs.ValidPath(name) {
+		return "", false
+	}
+
+	return name, true
+}
+
+func (fsrv *FileServer) serveFile(w *response.Writer, req *request.Request, name string, info fs.FileInfo) *server.HandlerError {
+	modTime := info.ModTime()
+	if notModified(req, modTime) {
+		w.WriteStatusLine(response.StatusNotModified)
+		h := headers.NewHeaders()
+		h.Set("Last-Modified", modTime.UTC().Format(response.TimeFormat))
+		w.WriteHeaders(h)
+		return nil
+	}
+
+	f, err := fsrv.fsys.Open(name)
+	if err != nil {
+		return statError(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, blockSize)
+	n, err := io.ReadAtLeast(f, buf, sniffLen)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return internalError()
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Content-Type", contentType(name, buf[:n]))
+	h.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	if !modTime.IsZero() {
+		h.Set("Last-Modified", modTime.UTC().Format(response.TimeFormat))
+	}
+
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+
+	body := bodyWriter{w}
+	if _, err := body.Write(buf[:n]); err != nil {
+		return internalError()
+	}
+
+	if _, err := io.CopyBuffer(body, f, buf); err != nil {
+		return internalError()
+	}
+
+	return nil
+}
+
+// bodyWriter sends what is written to it as part of the response body right
+// away, so files are streamed instead of held in memory.
+type bodyWriter struct {
+	w *response.Writer
+}
+
+func (b bodyWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n, err := b.w.WriteBody(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, b.w.Flush()
+}
+
+func (fsrv *FileServer) serveListing(w *response.Writer, req *request.Request, name string) *server.HandlerError {
+	entries, err := fs.ReadDir(fsrv.fsys, name)
+	if err != nil {
+		return statError(err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	title := html.EscapeString("Index of " + req.Path)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!doctype html>\n<html>\n<head>\n<title>%s</title>\n</head>\n<body>\n<h1>%s</h1>\n<ul>\n", title, title)
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() {
+			entryName += "/"
+		}
+
+		// Unlike EscapedPath, String makes sure a name like "a:b"
+		// isn't read as a URL scheme.
+		href := (&url.URL{Path: entryName}).String()
+
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(entryName))
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+
+	body := []byte(b.String())
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", "text/html; charset=utf-8")
+
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+	return nil
+}
+
+// notModified reports whether the request's If-Modified-Since shows the
+// client already has the version of the file last modified at modTime.
+func notModified(req *request.Request, modTime time.Time) bool {
+	if modTime.IsZero() {
+		return false
+	}
+
+	value, ok := req.Headers.Get("If-Modified-Since")
+	if !ok {
+		return false
+	}
+
+	since, err := time.Parse(response.TimeFormat, value)
+	if err != nil {
+		return false
+	}
+
+	// Dates on the wire have a one second resolution.
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// contentType picks the media type of a file from its extension or, if that
+// is unknown, from its first bytes.
+func contentType(name string, head []byte) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	}
+
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+
+	for _, sig := range signatures {
+		if strings.HasPrefix(string(head), sig.prefix) {
+			return sig.ctype
+		}
+	}
+
+	if isHTML(head) {
+		return "text/html; charset=utf-8"
+	}
+
+	// A cut in the middle of a multi-byte character is not a sign of
+	// binary data.
+	for i := 0; i < utf8.UTFMax && len(head) > 0 && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+	}
+
+	if utf8.Valid(head) && !strings.ContainsRune(string(head), 0) {
+		return "text/plain; charset=utf-8"
+	}
+
+	return "application/octet-stream"
+}
+
+// signatures are the magic numbers of the binary formats sniffed.
+var signatures = []struct {
+	prefix string
+	ctype  string
+}{
+	{"\x89PNG\r\n\x1a\n", "image/png"},
+	{"GIF87a", "image/gif"},
+	{"GIF89a", "image/gif"},
+	{"\xff\xd8\xff", "image/jpeg"},
+	{"%PDF-", "application/pdf"},
+}
+
+// htmlTags are the tags an HTML document is recognized by when it starts
+// with one, ignoring case and leading whitespace.
+var htmlTags = []string{"<!doctype html", "<html", "<head", "<body", "<title", "<p", "<h1", "<div", "<!--"}
+
+func isHTML(head []byte) bool {
+	s := strings.ToLower(strings.TrimLeft(string(head), " \t\r\n\f"))
+
+	for _, tag := range htmlTags {
+		rest, ok := strings.CutPrefix(s, tag)
+		if !ok {
+			continue
+		}
+
+		// "<p" mustn't match "<pre", nor "<html" "<htmlfoo".
+		if tag == "<!--" || rest == "" || strings.IndexByte(" \t\r\n\f>", rest[0]) != -1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func redirect(w *response.Writer, req *request.Request, location string) *server.HandlerError {
+	u := &url.URL{Path: location, RawQuery: req.RequestLine.RawQuery}
+
+	w.WriteStatusLine(response.StatusMovedPermanently)
+	h := response.GetDefaultHeaders(0)
+	h.Set("Location", u.String())
+	w.WriteHeaders(h)
+	return nil
+}
+
+func statError(err error) *server.HandlerError {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return notFound()
+	case errors.Is(err, fs.ErrPermission):
+		return &server.HandlerError{
+			Message:     "Forbidden\n",
+			ContentType: "text/plain",
+			StatusCode:  response.StatusForbidden,
+		}
+	default:
+		return internalError()
+	}
+}
+
+func notFound() *server.HandlerError {
+	return &server.HandlerError{
+		Message:     "Not Found\n",
+		ContentType: "text/plain",
+		StatusCode:  response.StatusNotFound,
+	}
+}
+
+func internalError() *server.HandlerError {
+	return &server.HandlerError{
+		Message:     "Internal Server Error\n",
+		ContentType: "text/plain",
+		StatusCode:  response.StatusInternalServerError,
+	}
+}
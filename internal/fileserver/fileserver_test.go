@@ -0,0 +1,187 @@
+package fileserver
+
+import (
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var modTime = time.Date(2024, time.March, 1, 12, 30, 45, 0, time.UTC)
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"index.html":     {Data: []byte("<h1>home</h1>"), ModTime: modTime},
+		"css/site.css":   {Data: []byte("body{}"), ModTime: modTime},
+		"docs/a.txt":     {Data: []byte("a"), ModTime: modTime},
+		"docs/b <i>":     {Data: []byte("b"), ModTime: modTime},
+		"docs/sub/c.txt": {Data: []byte("c"), ModTime: modTime},
+		"notes/README":   {Data: []byte("plain text\n"), ModTime: modTime},
+		"notes/blob":     {Data: []byte{0x00, 0x01, 0x02}, ModTime: modTime},
+		"notes/page":     {Data: []byte("<!DOCTYPE html><p>hi</p>"), ModTime: modTime},
+		"notes/logo":     {Data: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), ModTime: modTime},
+	}
+}
+
+// newRequest parses a request for target, so its Path is decoded and
+// normalized the way the server does it.
+func newRequest(t *testing.T, method string, target string) *request.Request {
+	t.Helper()
+
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: a\r\n\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+// serve runs fsrv for req and returns the response, or the HandlerError's
+// status code if the handler returned one.
+func serve(t *testing.T, fsrv *FileServer, req *request.Request) (string, response.StatusCode) {
+	t.Helper()
+
+	w := response.NewWriter(nil)
+	w.SetRequestMethod(req.RequestLine.Method)
+	if hErr := fsrv.ServeRequest(w, req); hErr != nil {
+		return "", hErr.StatusCode
+	}
+	require.NoError(t, w.Finish())
+
+	out := w.Buffer.String()
+	var code response.StatusCode
+	_, err := fmt.Sscanf(out, "HTTP/1.1 %d", &code)
+	require.NoError(t, err)
+	return out, code
+}
+
+func TestFileServer(t *testing.T) {
+	fsrv := New(testFS())
+
+	// Test: the root is served through its index.html
+	out, code := serve(t, fsrv, newRequest(t, "GET", "/"))
+	assert.Equal(t, response.StatusOK, code)
+	assert.Contains(t, out, "Content-Type: text/html; charset=utf-8\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n<h1>home</h1>"))
+
+	// Test: files get a type from their extension, a length and a date
+	out, code = serve(t, fsrv, newRequest(t, "GET", "/css/site.css"))
+	assert.Equal(t, response.StatusOK, code)
+	assert.Contains(t, out, "Content-Type: text/css; charset=utf-8\r\n")
+	assert.Contains(t, out, "Content-Length: 6\r\n")
+	assert.Contains(t, out, "Last-Modified: Fri, 01 Mar 2024 12:30:45 GMT\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nbody{}"))
+
+	// Test: HEAD gets the headers without the body
+	out, code = serve(t, fsrv, newRequest(t, "HEAD", "/css/site.css"))
+	assert.Equal(t, response.StatusOK, code)
+	assert.Contains(t, out, "Content-Length: 6\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	// Test: files without a known extension are sniffed
+	out, _ = serve(t, fsrv, newRequest(t, "GET", "/notes/README"))
+	assert.Contains(t, out, "Content-Type: text/plain; charset=utf-8\r\n")
+	out, _ = serve(t, fsrv, newRequest(t, "GET", "/notes/blob"))
+	assert.Contains(t, out, "Content-Type: application/octet-stream\r\n")
+	out, _ = serve(t, fsrv, newRequest(t, "GET", "/notes/page"))
+	assert.Contains(t, out, "Content-Type: text/html; charset=utf-8\r\n")
+	out, _ = serve(t, fsrv, newRequest(t, "GET", "/notes/logo"))
+	assert.Contains(t, out, "Content-Type: image/png\r\n")
+
+	// Test: a directory without a trailing slash is redirected, keeping the query
+	out, code = serve(t, fsrv, newRequest(t, "GET", "/docs?sort=name"))
+	assert.Equal(t, response.StatusMovedPermanently, code)
+	assert.Contains(t, out, "Location: /docs/?sort=name\r\n")
+
+	// Test: directories without an index.html are not listed by default
+	_, code = serve(t, fsrv, newRequest(t, "GET", "/docs/"))
+	assert.Equal(t, response.StatusNotFound, code)
+
+	// Test: missing files are a 404
+	_, code = serve(t, fsrv, newRequest(t, "GET", "/missing.txt"))
+	assert.Equal(t, response.StatusNotFound, code)
+
+	// Test: If-Modified-Since answers 304 for an unchanged file
+	req := newRequest(t, "GET", "/css/site.css")
+	req.Headers.Set("If-Modified-Since", "Fri, 01 Mar 2024 12:30:45 GMT")
+	out, code = serve(t, fsrv, req)
+	assert.Equal(t, response.StatusNotModified, code)
+	assert.NotContains(t, out, "body{}")
+
+	// Test: an older If-Modified-Since gets the file
+	req = newRequest(t, "GET", "/css/site.css")
+	req.Headers.Set("If-Modified-Since", "Fri, 01 Mar 2024 12:30:44 GMT")
+	_, code = serve(t, fsrv, req)
+	assert.Equal(t, response.StatusOK, code)
+
+	// Test: methods other than GET and HEAD are refused
+	out, code = serve(t, fsrv, newRequest(t, "POST", "/index.html"))
+	assert.Equal(t, response.StatusMethodNotAllowed, code)
+	assert.Contains(t, out, "Allow: GET, HEAD\r\n")
+}
+
+func TestFileServerListing(t *testing.T) {
+	fsrv := New(testFS())
+	fsrv.ListDirectories = true
+
+	// Test: entries are listed in order, escaped, with directories marked
+	out, code := serve(t, fsrv, newRequest(t, "GET", "/docs/"))
+	assert.Equal(t, response.StatusOK, code)
+	assert.Contains(t, out, "Content-Type: text/html; charset=utf-8\r\n")
+	assert.Contains(t, out, "<title>Index of /docs/</title>")
+	assert.Contains(t, out, "<li><a href=\"a.txt\">a.txt</a></li>\n"+
+		"<li><a href=\"b%20%3Ci%3E\">b &lt;i&gt;</a></li>\n"+
+		"<li><a href=\"sub/\">sub/</a></li>\n")
+
+	// Test: an index.html still wins over the listing
+	out, _ = serve(t, fsrv, newRequest(t, "GET", "/"))
+	assert.True(t, strings.HasSuffix(out, "<h1>home</h1>"))
+}
+
+func TestFileServerPaths(t *testing.T) {
+	fsrv := New(testFS())
+
+	// Test: dot-segments, encoded or not, can't climb above the root
+	for _, target := range []string{
+		"/../css/site.css",
+		"/docs/../../css/site.css",
+		"/docs/%2e%2e/%2E%2E/css/site.css",
+		"/%2e%2e%2fcss/site.css",
+	} {
+		out, code := serve(t, fsrv, newRequest(t, "GET", target))
+		assert.Equal(t, response.StatusOK, code, target)
+		assert.True(t, strings.HasSuffix(out, "body{}"), target)
+	}
+
+	// Test: an encoded slash is a separator like any other
+	out, code := serve(t, fsrv, newRequest(t, "GET", "/docs%2Fa.txt"))
+	assert.Equal(t, response.StatusOK, code)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\na"))
+
+	// Test: encoded backslashes are refused
+	_, code = serve(t, fsrv, newRequest(t, "GET", "/docs%5C..%5C..%5Cindex.html"))
+	assert.Equal(t, response.StatusNotFound, code)
+
+	// Test: an encoded NUL never gets past the parser
+	_, err := request.RequestFromReader(strings.NewReader("GET /index.html%00.css HTTP/1.1\r\nHost: a\r\n\r\n"))
+	require.ErrorIs(t, err, request.ErrInvalidTarget)
+
+	// Test: Prefix is removed before looking up the file
+	fsrv.Prefix = "/static/"
+	out, code = serve(t, fsrv, newRequest(t, "GET", "/static/css/site.css"))
+	assert.Equal(t, response.StatusOK, code)
+	assert.True(t, strings.HasSuffix(out, "body{}"))
+
+	// Test: dot-segments can't leave the prefix
+	_, code = serve(t, fsrv, newRequest(t, "GET", "/static/%2e%2e/index.html"))
+	assert.Equal(t, response.StatusNotFound, code)
+
+	// Test: paths outside the prefix are not served
+	_, code = serve(t, fsrv, newRequest(t, "GET", "/staticcss/site.css"))
+	assert.Equal(t, response.StatusNotFound, code)
+	_, code = serve(t, fsrv, newRequest(t, "GET", "/css/site.css"))
+	assert.Equal(t, response.StatusNotFound, code)
+}
@@ -3,25 +3,196 @@ package headers
 import (
 	"errors"
 	"fmt"
+	"io"
 	"strings"
 )
 
-type Headers map[string]string
+// Errors returned by Parse. Compare them with errors.Is.
+var (
+	ErrMalformedHeader   = errors.New("malformed header")
+	ErrInvalidFieldName  = errors.New("invalid field-name")
+	ErrInvalidFieldValue = errors.New("invalid field-value")
+	ErrObsFold           = errors.New("obsolete line folding")
+)
+
+// ParseOptions changes how ParseWithOptions treats lenient input.
+type ParseOptions struct {
+	// UnfoldObsFold accepts obsolete line folding, a line starting with
+	// whitespace that continues the previous field, by joining it to that
+	// field's value with a single space. Without it such lines are rejected
+	// with ErrObsFold.
+	UnfoldObsFold bool
+}
+
+type field struct {
+	name  string
+	value string
+}
+
+// Headers is an ordered list of header fields. Every instance of a repeated
+// field is kept, as is the casing and order in which fields were added, so
+// fields like Set-Cookie that can't be combined survive a round trip. Names
+// are compared case-insensitively.
+type Headers struct {
+	fields []field
+}
+
+func NewHeaders() *Headers {
+	return &Headers{}
+}
+
+// Get returns the values of key joined with ", ", the way repeated fields are
+// combined on the wire, and whether the field is present at all.
+func (h *Headers) Get(key string) (value string, ok bool) {
+
+	values := h.Values(key)
+
+	if len(values) == 0 {
+		return "", false
+	}
+
+	return strings.Join(values, ", "), true
+}
+
+// Values returns every value of key, in the order they were added.
+func (h *Headers) Values(key string) []string {
+	var values []string
+
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			values = append(values, f.value)
+		}
+	}
+
+	return values
+}
+
+// Has reports whether at least one field named key is present.
+func (h *Headers) Has(key string) bool {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Add appends a field, keeping any existing field with the same name. The
+// field is not added if key or value is invalid.
+func (h *Headers) Add(key string, value string) error {
+	if err := validateField(key, value); err != nil {
+		return err
+	}
+
+	h.fields = append(h.fields, field{name: key, value: value})
+	return nil
+}
+
+// Set replaces all the fields named key with a single one, at the position of
+// the first of them, or appends it if there were none. Nothing changes if key
+// or value is invalid.
+func (h *Headers) Set(key string, value string) error {
+	if err := validateField(key, value); err != nil {
+		return err
+	}
+
+	for i, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			h.fields[i] = field{name: key, value: value}
+			h.del(key, i+1)
+			return nil
+		}
+	}
+
+	h.fields = append(h.fields, field{name: key, value: value})
+	return nil
+}
+
+// Del removes all the fields named key.
+func (h *Headers) Del(key string) {
+	h.del(key, 0)
+}
+
+func (h *Headers) del(key string, from int) {
+	kept := h.fields[:from]
+
+	for _, f := range h.fields[from:] {
+		if !strings.EqualFold(f.name, key) {
+			kept = append(kept, f)
+		}
+	}
+
+	h.fields = kept
+}
+
+// Clone returns a copy of h that can be changed independently.
+func (h *Headers) Clone() *Headers {
+	clone := &Headers{
+		fields: make([]field, len(h.fields)),
+	}
+	copy(clone.fields, h.fields)
 
-func NewHeaders() Headers {
-	return Headers{}
+	return clone
 }
 
-func (h Headers) Get(key string) (value string, ok bool) {
+// Range calls fn for every field in order, with the name as it was added,
+// until fn returns false.
+func (h *Headers) Range(fn func(name string, value string) bool) {
+	for _, f := range h.fields {
+		if !fn(f.name, f.value) {
+			return
+		}
+	}
+}
+
+// Len returns the number of fields, counting every instance of a repeated
+// field.
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// WriteTo writes the fields in order, one "Name: value" line each with the
+// name in canonical case.
+func (h *Headers) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+
+	for _, f := range h.fields {
+		n, err := fmt.Fprintf(w, "%s: %s\r\n", CanonicalKey(f.name), f.value)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// CanonicalKey returns key with the first letter and every letter following
+// a hyphen upper-cased and the rest lower-cased, e.g. "content-type" becomes
+// "Content-Type".
+func CanonicalKey(key string) string {
+	b := []byte(key)
+	upper := true
 
-	lowerStr := strings.ToLower(key)
+	for i, c := range b {
+		switch {
+		case upper && c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case !upper && c >= 'A' && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+		upper = c == '-'
+	}
 
-	existingValue, ok := h[lowerStr]
+	return string(b)
+}
 
-	return existingValue, ok
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
+	return h.ParseWithOptions(data, ParseOptions{})
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+func (h *Headers) ParseWithOptions(data []byte, opts ParseOptions) (n int, done bool, err error) {
 	str := string(data)
 	delimiter := "\r\n"
 
@@ -37,41 +208,107 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 
 	headerStr := str[:dIndex+len(delimiter)]
 
-	trimmedDataStr := strings.TrimSpace(headerStr)
+	if headerStr[0] == ' ' || headerStr[0] == '\t' {
+		if !opts.UnfoldObsFold || len(h.fields) == 0 {
+			return 0, false, ErrObsFold
+		}
+
+		continuation := strings.Trim(str[:dIndex], " \t")
+		if !validateValue(continuation) {
+			return 0, false, fmt.Errorf("%w: %q", ErrInvalidFieldValue, continuation)
+		}
+
+		last := &h.fields[len(h.fields)-1]
+		if continuation != "" {
+			last.value = strings.TrimRight(last.value+" "+continuation, " ")
+		}
+
+		return len(headerStr), false, nil
+	}
+
+	trimmedDataStr := str[:dIndex]
 
 	firstColonPos := strings.Index(trimmedDataStr, ":")
 
 	if firstColonPos < 1 {
-		return 0, false, errors.New("malformed header")
+		return 0, false, ErrMalformedHeader
 	}
 
-	fieldName, fieldValue := trimmedDataStr[:firstColonPos], strings.TrimSpace(trimmedDataStr[firstColonPos+1:])
+	fieldName, fieldValue := trimmedDataStr[:firstColonPos], strings.Trim(trimmedDataStr[firstColonPos+1:], " \t")
 
 	if !validateKey(fieldName) {
-		return 0, false, errors.New("invalid field-name")
+		return 0, false, fmt.Errorf("%w: %q", ErrInvalidFieldName, fieldName)
 	}
 
-	fieldName = strings.ToLower(fieldName)
+	if !validateValue(fieldValue) {
+		return 0, false, fmt.Errorf("%w: %q", ErrInvalidFieldValue, fieldValue)
+	}
+
+	h.fields = append(h.fields, field{name: fieldName, value: fieldValue})
+
+	return len(headerStr), false, nil
+}
 
-	existingFieldValue, ok := h[fieldName]
+// HasToken reports whether the comma-separated value of key contains token,
+// compared case-insensitively, e.g. "Connection: keep-alive, Close".
+func (h *Headers) HasToken(key string, token string) bool {
+	value, ok := h.Get(key)
 
-	if ok {
-		fieldValue = existingFieldValue + ", " + fieldValue
+	if !ok {
+		return false
 	}
 
-	h[fieldName] = fieldValue
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
 
-	return len(headerStr), false, nil
+	return false
 }
 
-func (h Headers) Override(key string, value string) {
+// Override replaces the value of key, but only if the field is already
+// present.
+//
+// Deprecated: use Set, which also adds missing fields.
+func (h *Headers) Override(key string, value string) error {
+	if !h.Has(key) {
+		return nil
+	}
 
-	_, exists := h.Get(key)
+	return h.Set(key, value)
+}
 
-	if exists {
-		h.Parse([]byte(fmt.Sprintf("%s: %s\r\n", key, value)))
+// validateField checks a field set through the API rather than parsed off
+// the wire, so handlers can't inject extra fields or split a response.
+func validateField(key string, value string) error {
+	if key == "" || !validateKey(key) {
+		return fmt.Errorf("%w: %q", ErrInvalidFieldName, key)
 	}
 
+	if !validateValue(value) {
+		return fmt.Errorf("%w: %q", ErrInvalidFieldValue, value)
+	}
+
+	return nil
+}
+
+// validateValue checks value against the field-value grammar of RFC 9110
+// section 5.5: visible ASCII, obs-text bytes from 0x80 up, and spaces or tabs
+// between them. Control characters such as CR, LF and NUL are refused.
+func validateValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		switch {
+		case c == ' ' || c == '\t':
+			continue
+		case c < 0x20 || c == 0x7f:
+			return false
+		}
+	}
+
+	return true
 }
 
 func validateKey(key string) bool {
@@ -1,12 +1,19 @@
 package headers
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// value returns the combined value of key, or "" if it is missing.
+func value(h *Headers, key string) string {
+	v, _ := h.Get(key)
+	return v
+}
+
 func TestHeaders(t *testing.T) {
 	// Test: Valid single header
 	headers := NewHeaders()
@@ -14,7 +21,7 @@ func TestHeaders(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", value(headers, "host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -32,7 +39,7 @@ func TestHeaders(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", value(headers, "host"))
 	assert.Equal(t, 26, n)
 	assert.False(t, done)
 
@@ -42,9 +49,9 @@ func TestHeaders(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	assert.False(t, done)
-	assert.Equal(t, "Linux", headers["user-agent"])
+	assert.Equal(t, "Linux", value(headers, "user-agent"))
 	assert.Equal(t, 19, n)
-	assert.NotEqual(t, "*/*", headers["Accept"])
+	assert.NotEqual(t, "*/*", value(headers, "Accept"))
 
 
 	// Test: Valid done
@@ -67,20 +74,184 @@ func TestHeaders(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	assert.False(t, done)
-	assert.Equal(t, "lane-loves-go", headers["set-person"])
+	assert.Equal(t, "lane-loves-go", value(headers, "set-person"))
 	assert.Equal(t, 27, n)
 
 	data = []byte("Set-Person: prime-loves-zig\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	assert.False(t, done)
-	assert.Equal(t, "lane-loves-go, prime-loves-zig", headers["set-person"])
+	assert.Equal(t, "lane-loves-go, prime-loves-zig", value(headers, "set-person"))
 	assert.Equal(t, 29, n)
 
 	data = []byte("Set-Person: tj-loves-ocaml\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	assert.False(t, done)
-	assert.Equal(t, "lane-loves-go, prime-loves-zig, tj-loves-ocaml", headers["set-person"])
+	assert.Equal(t, "lane-loves-go, prime-loves-zig, tj-loves-ocaml", value(headers, "set-person"))
 	assert.Equal(t, 28, n)
 }
+
+func TestHeadersMultiValue(t *testing.T) {
+	// Test: Repeated fields are kept apart, in order
+	headers := NewHeaders()
+	for _, line := range []string{
+		"Set-Cookie: a=1; Path=/\r\n",
+		"Content-Type: text/plain\r\n",
+		"set-cookie: b=2, c=3\r\n",
+	} {
+		_, _, err := headers.Parse([]byte(line))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 3, headers.Len())
+	assert.Equal(t, []string{"a=1; Path=/", "b=2, c=3"}, headers.Values("SET-COOKIE"))
+	assert.Equal(t, "a=1; Path=/, b=2, c=3", value(headers, "Set-Cookie"))
+
+	// Test: Original casing and order are visible through Range
+	names := []string{}
+	headers.Range(func(name string, value string) bool {
+		names = append(names, name)
+		return true
+	})
+	assert.Equal(t, []string{"Set-Cookie", "Content-Type", "set-cookie"}, names)
+
+	// Test: Output uses canonical names and keeps the order
+	var out strings.Builder
+	_, err := headers.WriteTo(&out)
+	require.NoError(t, err)
+	assert.Equal(t, "Set-Cookie: a=1; Path=/\r\nContent-Type: text/plain\r\nSet-Cookie: b=2, c=3\r\n", out.String())
+
+	// Test: Add appends another instance
+	headers.Add("Vary", "Accept")
+	headers.Add("vary", "Origin")
+	assert.Equal(t, []string{"Accept", "Origin"}, headers.Values("Vary"))
+
+	// Test: Set replaces every instance at the position of the first
+	headers.Set("SET-COOKIE", "d=4")
+	assert.Equal(t, []string{"d=4"}, headers.Values("Set-Cookie"))
+	names = []string{}
+	headers.Range(func(name string, value string) bool {
+		names = append(names, name)
+		return true
+	})
+	assert.Equal(t, []string{"SET-COOKIE", "Content-Type", "Vary", "vary"}, names)
+
+	// Test: Set appends a missing field
+	headers.Set("X-New", "yes")
+	assert.Equal(t, "yes", value(headers, "x-new"))
+
+	// Test: Del removes every instance
+	headers.Del("vary")
+	_, ok := headers.Get("Vary")
+	assert.False(t, ok)
+	assert.Equal(t, 3, headers.Len())
+
+	// Test: Canonical keys
+	assert.Equal(t, "Content-Type", CanonicalKey("content-type"))
+	assert.Equal(t, "X-Request-Id", CanonicalKey("X-REQUEST-ID"))
+	assert.Equal(t, "Www-Authenticate", CanonicalKey("www-authenticate"))
+}
+
+func TestHeadersMutation(t *testing.T) {
+	// Test: Override replaces instead of appending
+	headers := NewHeaders()
+	headers.Parse([]byte("Content-Length: 12\r\n"))
+	headers.Parse([]byte("Content-Type: text/plain\r\n"))
+	err := headers.Override("Content-Type", "text/html")
+	require.NoError(t, err)
+	assert.Equal(t, "text/html", value(headers, "Content-Type"))
+	assert.Equal(t, []string{"text/html"}, headers.Values("Content-Type"))
+
+	// Test: Override leaves missing fields alone
+	err = headers.Override("X-Missing", "value")
+	require.NoError(t, err)
+	assert.False(t, headers.Has("X-Missing"))
+
+	// Test: Set adds missing fields and Has sees them
+	err = headers.Set("Cache-Control", "no-store")
+	require.NoError(t, err)
+	assert.True(t, headers.Has("cache-control"))
+
+	// Test: Invalid names and values are refused without changing anything
+	err = headers.Set("Bad Name", "value")
+	require.ErrorIs(t, err, ErrInvalidFieldName)
+	err = headers.Add("", "value")
+	require.ErrorIs(t, err, ErrInvalidFieldName)
+	err = headers.Set("Content-Type", "text/html\r\nSet-Cookie: admin=1")
+	require.ErrorIs(t, err, ErrInvalidFieldValue)
+	err = headers.Add("X-Nul", "a\x00b")
+	require.ErrorIs(t, err, ErrInvalidFieldValue)
+	assert.Equal(t, "text/html", value(headers, "Content-Type"))
+	assert.Equal(t, 3, headers.Len())
+
+	// Test: Del removes the field
+	headers.Del("Cache-Control")
+	assert.False(t, headers.Has("Cache-Control"))
+
+	// Test: Clone is independent from the original
+	clone := headers.Clone()
+	clone.Set("Content-Type", "application/json")
+	clone.Add("X-Extra", "1")
+	assert.Equal(t, "text/html", value(headers, "Content-Type"))
+	assert.False(t, headers.Has("X-Extra"))
+	assert.Equal(t, "application/json", value(clone, "Content-Type"))
+
+	// Test: Range stops when asked to
+	count := 0
+	clone.Range(func(name string, value string) bool {
+		count++
+		return false
+	})
+	assert.Equal(t, 1, count)
+}
+
+func TestHeaderValues(t *testing.T) {
+	// Test: Control characters in values are rejected
+	for _, line := range []string{
+		"X-Bad: a\rb\r\n",
+		"X-Bad: a\x00b\r\n",
+		"X-Bad: a\nX-Injected: 1\r\n",
+		"X-Bad: a\x7fb\r\n",
+		"X-Bad: \x1b[31m\r\n",
+	} {
+		headers := NewHeaders()
+		n, done, err := headers.Parse([]byte(line))
+		require.ErrorIs(t, err, ErrInvalidFieldValue, line)
+		assert.Equal(t, 0, n)
+		assert.False(t, done)
+	}
+
+	// Test: Tabs, visible characters and obs-text are accepted
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("X-Good:\tcafé\t\"quoted\" (comment)\t\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "café\t\"quoted\" (comment)", value(headers, "X-Good"))
+
+	// Test: Obsolete line folding is rejected by default
+	headers = NewHeaders()
+	_, _, err = headers.Parse([]byte("X-Folded: first\r\n"))
+	require.NoError(t, err)
+	_, _, err = headers.Parse([]byte("  second\r\n"))
+	require.ErrorIs(t, err, ErrObsFold)
+
+	// Test: Obsolete line folding can be unfolded
+	opts := ParseOptions{UnfoldObsFold: true}
+	headers = NewHeaders()
+	data := []byte("X-Folded: first\r\n  second\r\n\tthird \r\nHost: localhost\r\n\r\n")
+	for {
+		n, done, err := headers.ParseWithOptions(data, opts)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, "first second third", value(headers, "X-Folded"))
+	assert.Equal(t, "localhost", value(headers, "Host"))
+	assert.Equal(t, 2, headers.Len())
+
+	// Test: A fold with nothing to continue is rejected even when unfolding
+	headers = NewHeaders()
+	_, _, err = headers.ParseWithOptions([]byte(" orphan\r\n"), opts)
+	require.ErrorIs(t, err, ErrObsFold)
+}
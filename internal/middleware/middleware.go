@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Captured describes the response a handler produced, as seen once it has
+// returned.
+type Captured struct {
+	StatusCode   response.StatusCode
+	BytesWritten int
+	Duration     time.Duration
+	Err          *server.HandlerError
+}
+
+// Capture runs next and reports the status code, body size and time taken.
+// When next returns a HandlerError without having written anything, the
+// status and size are those of the error response the server will send.
+func Capture(next server.Handler, w *response.Writer, req *request.Request) Captured {
+	start := time.Now()
+	hErr := next(w, req)
+
+	captured := Captured{
+		StatusCode:   w.Status(),
+		BytesWritten: w.BytesWritten(),
+		Duration:     time.Since(start),
+		Err:          hErr,
+	}
+
+	if hErr != nil && !w.Written() {
+		captured.StatusCode = hErr.StatusCode
+		captured.BytesWritten = len(hErr.Message)
+	}
+
+	return captured
+}
+
+// Logging logs one line per request with its method, target, status code,
+// body size and duration.
+func Logging(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) *server.HandlerError {
+		captured := Capture(next, w, req)
+
+		log.Printf("%s %s %d %dB %s\n",
+			req.RequestLine.Method,
+			req.RequestLine.RequestTarget,
+			captured.StatusCode,
+			captured.BytesWritten,
+			captured.Duration,
+		)
+
+		return captured.Err
+	}
+}
+
+// Recover turns a panic in next into a 500 response. If the response had
+// already started, it is aborted instead, so the client doesn't take the
+// partial response for a complete one, and the connection is closed.
+func Recover(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) (hErr *server.HandlerError) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic serving %s: %v\n%s", req.RequestLine.RequestTarget, r, debug.Stack())
+
+				if w.Written() {
+					w.Abort()
+				}
+
+				hErr = &server.HandlerError{
+					Message:     "Internal Server Error\n",
+					ContentType: "text/plain",
+					StatusCode:  response.StatusInternalServerError,
+				}
+			}
+		}()
+
+		return next(w, req)
+	}
+}
+
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// RequestID makes sure every request carries an X-Request-Id header, keeping
+// the one sent by the client or generating a new one, and echoes it on the
+// response. The ID is also stored in the request context, see
+// RequestIDFromContext.
+func RequestID(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) *server.HandlerError {
+		id, ok := req.Headers.Get(RequestIDHeader)
+		if !ok || id == "" {
+			id = newRequestID()
+			req.Headers.Set(RequestIDHeader, id)
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+
+		return next(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	}
+}
+
+// RequestIDFromContext returns the request ID stored by RequestID, or "" if
+// there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(buf)
+}
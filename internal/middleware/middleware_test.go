@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest() *request.Request {
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			HttpVersion:   "1.1",
+			RequestTarget: "/",
+			Method:        "GET",
+		},
+		Headers: headers.NewHeaders(),
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	// Test: Chain runs middleware outermost first
+	order := []string{}
+	mark := func(name string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(w *response.Writer, req *request.Request) *server.HandlerError {
+				order = append(order, name)
+				return next(w, req)
+			}
+		}
+	}
+	handler := server.Chain(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		order = append(order, "handler")
+		return nil
+	}, mark("a"), mark("b"))
+	handler(response.NewWriter(nil), newRequest())
+	assert.Equal(t, []string{"a", "b", "handler"}, order)
+
+	// Test: Capture sees status and body size
+	captured := Capture(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		body := []byte("hello")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}, response.NewWriter(nil), newRequest())
+	assert.Equal(t, response.StatusOK, captured.StatusCode)
+	assert.Equal(t, 5, captured.BytesWritten)
+	assert.Nil(t, captured.Err)
+
+	// Test: Capture reports a returned HandlerError
+	captured = Capture(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		return &server.HandlerError{Message: "nope", StatusCode: response.StatusBadRequest}
+	}, response.NewWriter(nil), newRequest())
+	assert.Equal(t, response.StatusBadRequest, captured.StatusCode)
+	require.NotNil(t, captured.Err)
+
+	// Test: Recover turns a panic into a 500
+	hErr := Recover(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		panic("boom")
+	})(response.NewWriter(nil), newRequest())
+	require.NotNil(t, hErr)
+	assert.Equal(t, response.StatusInternalServerError, hErr.StatusCode)
+
+	// Test: Recover aborts a response the panic cut short
+	w := response.NewWriter(nil)
+	hErr = Recover(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteBody([]byte("partial"))
+		panic("boom")
+	})(w, newRequest())
+	require.NotNil(t, hErr)
+	assert.ErrorIs(t, w.Finish(), response.ErrAborted)
+	assert.Empty(t, w.Buffer.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: RequestID keeps the client's id and echoes it
+	req := newRequest()
+	req.Headers.Set("X-Request-Id", "abc")
+	w = response.NewWriter(nil)
+	RequestID(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return nil
+	})(w, req)
+	assert.Contains(t, w.Buffer.String(), "X-Request-Id: abc\r\n")
+
+	// Test: RequestID generates an id when there is none
+	req = newRequest()
+	RequestID(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		return nil
+	})(response.NewWriter(nil), req)
+	id, ok := req.Headers.Get("X-Request-Id")
+	assert.True(t, ok)
+	assert.Len(t, id, 32)
+
+	// Test: RequestID stores the id in the request context
+	req = newRequest()
+	req.Headers.Set("X-Request-Id", "abc")
+	var fromContext string
+	RequestID(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		fromContext = RequestIDFromContext(req.Context())
+		return nil
+	})(response.NewWriter(nil), req)
+	assert.Equal(t, "abc", fromContext)
+	assert.Equal(t, "", RequestIDFromContext(newRequest().Context()))
+}
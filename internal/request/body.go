@@ -0,0 +1,60 @@
+package request
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrBodyClosed is returned when reading a BodyReader after closing it.
+var ErrBodyClosed = errors.New("read on closed body")
+
+// bodyReader hands out the body of a request as the Reader parses it off the
+// connection, so no more than what has been received so far is held in
+// memory.
+type bodyReader struct {
+	reader  *Reader
+	request *Request
+	closed  bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyClosed
+	}
+
+	req := b.request
+
+	if len(req.pending) == 0 && req.Status != Done {
+		if req.bodyErr != nil {
+			return 0, req.bodyErr
+		}
+
+		err := b.reader.readUntil(req, func() bool {
+			return len(req.pending) > 0 || req.Status == Done
+		})
+		if err == nil && len(req.pending) == 0 && req.Status != Done {
+			err = ErrIncompleteBody
+		}
+
+		if err != nil {
+			// The parser can't resume after an error, so it sticks.
+			req.bodyErr = err
+			return 0, err
+		}
+	}
+
+	if len(req.pending) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, req.pending)
+	req.pending = req.pending[n:]
+	return n, nil
+}
+
+// Close stops further reads. It doesn't consume the rest of the body; the
+// server does that before reading the next request.
+func (b *bodyReader) Close() error {
+	b.closed = true
+	return nil
+}
@@ -0,0 +1,28 @@
+package request
+
+import "errors"
+
+// Errors returned while parsing a request. They are usually wrapped with the
+// offending value, so compare them with errors.Is.
+var (
+	ErrMalformedRequestLine = errors.New("malformed request line")
+	ErrInvalidMethod        = errors.New("invalid method")
+	ErrInvalidTarget        = errors.New("invalid request target")
+	ErrUnsupportedVersion   = errors.New("unsupported HTTP version")
+	ErrMissingHost          = errors.New("missing host header")
+	ErrUnsupportedExpect    = errors.New("unsupported expectation")
+
+	ErrBadContentLength            = errors.New("invalid content-length")
+	ErrAmbiguousLength             = errors.New("ambiguous message length")
+	ErrInvalidTransferEncoding     = errors.New("invalid transfer-encoding")
+	ErrUnsupportedTransferEncoding = errors.New("unsupported transfer-encoding")
+	ErrMalformedChunk              = errors.New("malformed chunk")
+	ErrForbiddenTrailer            = errors.New("forbidden trailer field")
+	ErrIncompleteBody              = errors.New("incomplete body")
+
+	ErrRequestLineTooLong = errors.New("request line too long")
+	ErrHeaderTooLarge     = errors.New("header section too large")
+	ErrTooManyHeaders     = errors.New("too many header fields")
+	ErrChunkLineTooLong   = errors.New("chunk size line too long")
+	ErrBodyTooLarge       = errors.New("body too large")
+)
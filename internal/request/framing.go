@@ -0,0 +1,274 @@
+package request
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxContentLengthDigits keeps Content-Length values within what an int64
+// can hold before they are converted.
+const maxContentLengthDigits = 18
+
+// determineFraming works out how the body of the request is delimited, once
+// its headers are parsed, following the message body length rules of RFC 9112
+// section 6.3. Requests that a server and an intermediary could disagree on
+// are refused rather than guessed at, since that disagreement is what request
+// smuggling relies on.
+func (r *Request) determineFraming() error {
+	_, hasTE := r.Headers.Get("Transfer-Encoding")
+	_, hasCL := r.Headers.Get("Content-Length")
+
+	if hasTE && hasCL {
+		return fmt.Errorf("%w: both Transfer-Encoding and Content-Length are present", ErrAmbiguousLength)
+	}
+
+	if hasTE {
+		if r.RequestLine.HttpVersion == "1.0" {
+			// HTTP/1.0 has no transfer codings, so a 1.0 recipient
+			// downstream would frame this message differently.
+			return fmt.Errorf("%w: transfer-encoding in an HTTP/1.0 request", ErrInvalidTransferEncoding)
+		}
+
+		if err := r.checkTransferEncoding(); err != nil {
+			return err
+		}
+
+		r.chunked = true
+		return nil
+	}
+
+	if hasCL {
+		contentLength, err := r.parseContentLength()
+		if err != nil {
+			return err
+		}
+
+		r.contentLength = contentLength
+	}
+
+	return nil
+}
+
+// checkTransferEncoding makes sure chunked is the final transfer coding,
+// applied once, and that no other coding is used since none are supported.
+func (r *Request) checkTransferEncoding() error {
+	values := r.Headers.Values("Transfer-Encoding")
+
+	if r.strict && (len(values) != 1 || !strings.EqualFold(values[0], "chunked")) {
+		return fmt.Errorf("%w: %q", ErrInvalidTransferEncoding, strings.Join(values, ", "))
+	}
+
+	var codings []string
+	for _, value := range values {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.Trim(coding, " \t")
+			if coding == "" {
+				continue
+			}
+
+			codings = append(codings, strings.ToLower(coding))
+		}
+	}
+
+	if len(codings) == 0 {
+		return fmt.Errorf("%w: empty transfer-encoding", ErrInvalidTransferEncoding)
+	}
+
+	for i, coding := range codings {
+		if coding == "chunked" && i != len(codings)-1 {
+			return fmt.Errorf("%w: chunked is not the final coding", ErrInvalidTransferEncoding)
+		}
+	}
+
+	for _, coding := range codings {
+		if coding != "chunked" {
+			return fmt.Errorf("%w: %s", ErrUnsupportedTransferEncoding, coding)
+		}
+	}
+
+	return nil
+}
+
+// parseContentLength returns the length given by the Content-Length fields.
+// A list of identical values, e.g. "42, 42" or the same field sent twice, is
+// accepted as RFC 9110 section 8.6 allows, except in strict mode; differing
+// values are refused.
+func (r *Request) parseContentLength() (int, error) {
+	values := r.Headers.Values("Content-Length")
+
+	if r.strict && (len(values) != 1 || strings.Contains(values[0], ",")) {
+		return 0, fmt.Errorf("%w: repeated content-length", ErrAmbiguousLength)
+	}
+
+	length := ""
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.Trim(part, " \t")
+
+			if !isDigits(part) {
+				return 0, fmt.Errorf("%w: %q", ErrBadContentLength, part)
+			}
+
+			// Compare without the leading zeros, so "05" and "5" agree.
+			if trimmed := strings.TrimLeft(part, "0"); trimmed != "" {
+				part = trimmed
+			} else {
+				part = "0"
+			}
+
+			if length != "" && part != length {
+				return 0, fmt.Errorf("%w: conflicting content-lengths %s and %s", ErrAmbiguousLength, length, part)
+			}
+			length = part
+		}
+	}
+
+	if len(length) > maxContentLengthDigits {
+		return 0, ErrBodyTooLarge
+	}
+
+	contentLength, err := strconv.ParseInt(length, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrBadContentLength, length)
+	}
+
+	if contentLength > int64(r.limits.MaxBodyBytes) {
+		return 0, ErrBodyTooLarge
+	}
+
+	return int(contentLength), nil
+}
+
+// checkTrailers refuses, in strict mode, trailer fields that would change how
+// the message is framed or routed if an intermediary merged them into the
+// header section.
+func (r *Request) checkTrailers() error {
+	if !r.strict {
+		return nil
+	}
+
+	for _, name := range []string{"Content-Length", "Transfer-Encoding", "Host"} {
+		if r.Trailers.Has(name) {
+			return fmt.Errorf("%w: %s", ErrForbiddenTrailer, name)
+		}
+	}
+
+	return nil
+}
+
+// isDigits reports whether s is a non-empty run of ASCII digits, with no sign
+// or spaces, unlike what strconv.Atoi accepts.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validChunkExt checks what follows the chunk size on a chunk-size line
+// against the chunk-ext grammar of RFC 9112 section 7.1.1:
+//
+//	chunk-ext = *( BWS ";" BWS chunk-ext-name [ BWS "=" BWS chunk-ext-val ] )
+//
+// Extensions are ignored, but one that doesn't parse, such as one hiding a
+// bare LF, could make an intermediary find the chunk data elsewhere.
+func validChunkExt(ext string) bool {
+	i := 0
+	for {
+		i = skipBWS(ext, i)
+		if i == len(ext) {
+			return true
+		}
+
+		if ext[i] != ';' {
+			return false
+		}
+
+		i = skipBWS(ext, i+1)
+		n := tokenLen(ext[i:])
+		if n == 0 {
+			return false
+		}
+		i += n
+
+		j := skipBWS(ext, i)
+		if j == len(ext) || ext[j] != '=' {
+			continue
+		}
+
+		i = skipBWS(ext, j+1)
+		if i < len(ext) && ext[i] == '"' {
+			n = quotedStringLen(ext[i:])
+		} else {
+			n = tokenLen(ext[i:])
+		}
+		if n == 0 {
+			return false
+		}
+		i += n
+	}
+}
+
+func skipBWS(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+
+	return i
+}
+
+// tokenLen returns the length of the token at the start of s.
+func tokenLen(s string) int {
+	n := 0
+	for n < len(s) && isTokenChar(s[n]) {
+		n++
+	}
+
+	return n
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	default:
+		return strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+	}
+}
+
+// quotedStringLen returns the length of the quoted-string at the start of s,
+// or 0 if it is malformed or not terminated.
+func quotedStringLen(s string) int {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c == '"':
+			return i + 1
+		case c == '\\':
+			i++
+			if i == len(s) || !isQuotedPairChar(s[i]) {
+				return 0
+			}
+		case c == '\t' || c == ' ' || c == 0x21 || c >= 0x23 && c <= 0x7e || c >= 0x80:
+		default:
+			return 0
+		}
+	}
+
+	return 0
+}
+
+// isQuotedPairChar reports whether c may follow a backslash in a
+// quoted-string: HTAB, SP, VCHAR or obs-text.
+func isQuotedPairChar(c byte) bool {
+	return c == '\t' || c == ' ' || c >= 0x21 && c <= 0x7e || c >= 0x80
+}
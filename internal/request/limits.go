@@ -0,0 +1,44 @@
+package request
+
+const (
+	DefaultMaxRequestLineBytes = 8 << 10
+	DefaultMaxHeaderBytes      = 1 << 20
+	DefaultMaxHeaderCount      = 100
+	DefaultMaxBodyBytes        = 10 << 20
+)
+
+// maxChunkLineBytes is the longest chunk-size line accepted, extensions and
+// CRLF included. Legitimate lines are a few bytes long, so it isn't
+// configurable.
+const maxChunkLineBytes = 4 << 10
+
+// Limits caps the size of the parts of a request so a single client can't
+// exhaust the server's memory. A zero field uses the matching default.
+type Limits struct {
+	// MaxRequestLineBytes is the longest request line accepted, CRLF included.
+	MaxRequestLineBytes int
+	// MaxHeaderBytes is the largest header section accepted, trailer fields
+	// included.
+	MaxHeaderBytes int
+	// MaxHeaderCount is the most header and trailer fields accepted.
+	MaxHeaderCount int
+	// MaxBodyBytes is the largest decoded body accepted.
+	MaxBodyBytes int
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxRequestLineBytes == 0 {
+		l.MaxRequestLineBytes = DefaultMaxRequestLineBytes
+	}
+	if l.MaxHeaderBytes == 0 {
+		l.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if l.MaxHeaderCount == 0 {
+		l.MaxHeaderCount = DefaultMaxHeaderCount
+	}
+	if l.MaxBodyBytes == 0 {
+		l.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+
+	return l
+}
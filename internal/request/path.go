@@ -0,0 +1,147 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Values maps a query parameter name to all the values it was given, in the
+// order they appear.
+type Values map[string][]string
+
+// Get returns the first value of key, or "" if there is none.
+func (v Values) Get(key string) string {
+	if values := v[key]; len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+func (v Values) Has(key string) bool {
+	_, ok := v[key]
+	return ok
+}
+
+// Query parses RequestLine.RawQuery. Pairs that aren't correctly
+// percent-encoded are skipped.
+func (r *Request) Query() Values {
+	values := Values{}
+
+	for _, pair := range strings.Split(r.RequestLine.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+
+		key, err := unescape(rawKey, true)
+		if err != nil {
+			continue
+		}
+
+		value, err := unescape(rawValue, true)
+		if err != nil {
+			continue
+		}
+
+		values[key] = append(values[key], value)
+	}
+
+	return values
+}
+
+// canonicalPath percent-decodes rawPath, then collapses duplicate slashes and
+// removes "." and ".." segments, so "/a//b/%2e%2e/c" becomes "/a/c". A ".."
+// can never climb above the root. With rejectEncodedSlashes, "%2F" is refused
+// rather than decoded into a separator.
+func canonicalPath(rawPath string, rejectEncodedSlashes bool) (string, error) {
+	if rejectEncodedSlashes && strings.Contains(strings.ToUpper(rawPath), "%2F") {
+		return "", fmt.Errorf("%w: encoded slash in %s", ErrInvalidTarget, rawPath)
+	}
+
+	path, err := unescape(rawPath, false)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidTarget, rawPath)
+	}
+
+	if strings.ContainsRune(path, 0) {
+		return "", fmt.Errorf("%w: NUL in %s", ErrInvalidTarget, rawPath)
+	}
+
+	segments := strings.Split(path, "/")
+	cleaned := make([]string, 0, len(segments))
+	trailingSlash := false
+
+	for i, segment := range segments {
+		if i == 0 {
+			continue
+		}
+
+		last := i == len(segments)-1
+		trailingSlash = false
+
+		switch segment {
+		case "":
+			trailingSlash = last
+		case ".":
+			trailingSlash = true
+		case "..":
+			if len(cleaned) > 0 {
+				cleaned = cleaned[:len(cleaned)-1]
+			}
+			trailingSlash = true
+		default:
+			cleaned = append(cleaned, segment)
+		}
+	}
+
+	result := "/" + strings.Join(cleaned, "/")
+	if trailingSlash && len(cleaned) > 0 {
+		result += "/"
+	}
+
+	return result, nil
+}
+
+// unescape decodes %XX escapes in s and, in query components, "+" as a space.
+func unescape(s string, query bool) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return "", fmt.Errorf("invalid escape in %q", s)
+			}
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case s[i] == '+' && query:
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String(), nil
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -1,13 +1,14 @@
 package request
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
 	"strconv"
 	"strings"
-	"unicode"
 )
 
 type RequestStatus int
@@ -16,20 +17,143 @@ const (
 	Initialized RequestStatus = iota
 	ParsingHeaders
 	ParsingBody
+	ParsingChunkSize
+	ParsingChunkData
+	ParsingChunkDataEnd
+	ParsingTrailers
 	Done
 )
 
 type Request struct {
 	RequestLine RequestLine
 	Status      RequestStatus
-	Headers     headers.Headers
-	Body        []byte
+	Headers     *headers.Headers
+	Trailers    *headers.Headers
+
+	// BodyReader streams the body from the connection as it is read. It
+	// returns io.EOF at the end of the body, right away if there is none,
+	// and Trailers are complete once it has. Reading it is optional: the
+	// server discards whatever is left once the handler returns.
+	BodyReader io.ReadCloser
+	// Body holds the whole body when it was buffered up front, by
+	// Reader.ReadBody, RequestFromReader or a server configured with
+	// BufferBody. It is nil otherwise.
+	Body []byte
+
+	// Path is the decoded and normalized path of the target, see
+	// canonicalPath. It is empty for authority-form and asterisk-form
+	// targets. Route and authorize on Path rather than on the raw target.
+	Path string
+
+	ctx                  context.Context
+	limits               Limits
+	rejectEncodedSlashes bool
+	strict               bool
+	headerOptions        headers.ParseOptions
+	headerBytes          int
+	headerCount          int
+	chunked              bool
+	contentLength        int
+	chunkRemaining       int
+	bodyRead             int
+	pending              []byte
+	bodyErr              error
+	pathValues           map[string]string
+}
+
+// Context returns the context of the request, or context.Background() if it
+// has none. The server cancels it when the client goes away, when the handler
+// runs out of time or when the server shuts down; context.Cause tells which.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx, for
+// middleware to attach values or deadlines before calling the next handler.
+// The copy shares its headers and body with r.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("request: nil context")
+	}
+
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// PathValue returns the value captured for the named wildcard in the pattern
+// that matched the request, or "" if there is none.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+func (r *Request) SetPathValue(name string, value string) {
+	if r.pathValues == nil {
+		r.pathValues = map[string]string{}
+	}
+
+	r.pathValues[name] = value
+}
+
+// KeepAlive reports whether the client expects the connection to stay open
+// after the response. HTTP/1.1 connections are persistent unless the client
+// sends "Connection: close", HTTP/1.0 ones only with "Connection: keep-alive".
+func (r *Request) KeepAlive() bool {
+	if r.RequestLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken("Connection", "keep-alive")
+	}
+
+	return !r.Headers.HasToken("Connection", "close")
+}
+
+// ExpectContinue reports whether the client sent "Expect: 100-continue" and
+// waits for a 100 Continue before sending the body. The expectation is
+// ignored for HTTP/1.0 requests, as RFC 9110 requires.
+func (r *Request) ExpectContinue() bool {
+	if r.RequestLine.HttpVersion == "1.0" {
+		return false
+	}
+
+	value, ok := r.Headers.Get("Expect")
+	return ok && strings.EqualFold(value, "100-continue")
+}
+
+// UnreadBodyLength returns how many bytes of the body are left to read
+// through BodyReader, or -1 if the body is chunked and its end hasn't been
+// reached yet.
+func (r *Request) UnreadBodyLength() int {
+	switch {
+	case r.Status == Done:
+		return len(r.pending)
+	case r.chunked:
+		return -1
+	default:
+		return r.contentLength - r.bodyRead + len(r.pending)
+	}
 }
 
 type RequestLine struct {
 	HttpVersion   string
 	RequestTarget string
 	Method        string
+
+	// Form is the form of RequestTarget, which decides which of the fields
+	// below are set.
+	Form TargetForm
+	// Scheme is set for absolute-form targets, lower-cased.
+	Scheme string
+	// Authority is the "host[:port]" of absolute-form and authority-form
+	// targets.
+	Authority string
+	// RawPath is the path of origin-form and absolute-form targets, as sent.
+	RawPath string
+	// RawQuery is the query of origin-form and absolute-form targets,
+	// without the "?".
+	RawQuery string
 }
 
 func (r *Request) parse(data []byte) (int, error) {
@@ -42,9 +166,23 @@ func (r *Request) parse(data []byte) (int, error) {
 		if err != nil {
 			return -1, err
 		} else if bytesConsumed == 0 {
+			if len(data) > r.limits.MaxRequestLineBytes {
+				return -1, ErrRequestLineTooLong
+			}
 			return 0, nil
 		}
 
+		if bytesConsumed > r.limits.MaxRequestLineBytes {
+			return -1, ErrRequestLineTooLong
+		}
+
+		if parsedLine.Form == OriginForm || parsedLine.Form == AbsoluteForm {
+			r.Path, err = canonicalPath(parsedLine.RawPath, r.rejectEncodedSlashes)
+			if err != nil {
+				return -1, err
+			}
+		}
+
 		r.RequestLine = *parsedLine
 		r.Status = ParsingHeaders
 		totalBytesConsumed = bytesConsumed
@@ -54,12 +192,16 @@ func (r *Request) parse(data []byte) (int, error) {
 	for r.Status != Done {
 		switch r.Status {
 		case ParsingHeaders:
-			n, done, err := r.Headers.Parse(data[totalBytesConsumed:])
+			n, done, err := r.Headers.ParseWithOptions(data[totalBytesConsumed:], r.headerOptions)
 
 			if err != nil {
 				return 0, err
 			}
 
+			if err := r.checkHeaderLimits(data[totalBytesConsumed:], n, done); err != nil {
+				return 0, err
+			}
+
 			if n == 0 {
 				return 0, nil
 			}
@@ -67,40 +209,125 @@ func (r *Request) parse(data []byte) (int, error) {
 			totalBytesConsumed += n
 
 			if done {
+				if err := r.determineFraming(); err != nil {
+					return 0, err
+				}
+
 				r.Status = ParsingBody
 				continue
 			}
 
 			return totalBytesConsumed, nil
 		case ParsingBody:
-			remaining := data[totalBytesConsumed:]
-			value, ok := r.Headers.Get("Content-Length")
-			if !ok {
+			if r.chunked {
+				r.Status = ParsingChunkSize
+				continue
+			}
+
+			if r.contentLength == 0 {
 				r.Status = Done
 				return totalBytesConsumed, nil
 			}
 
-			contentLength, err := strconv.Atoi(value)
+			// Only take what the content-length asks for, anything after it
+			// belongs to the next request on the connection.
+			remaining := data[totalBytesConsumed:]
+			needed := r.contentLength - r.bodyRead
+			if needed > len(remaining) {
+				needed = len(remaining)
+			}
+
+			r.pending = append(r.pending, remaining[:needed]...)
+			r.bodyRead += needed
+			totalBytesConsumed += needed
+
+			if r.bodyRead == r.contentLength {
+				r.Status = Done
+			}
+
+			return totalBytesConsumed, nil
+		case ParsingChunkSize:
+			chunkSize, n, err := parseChunkSize(data[totalBytesConsumed:])
+
 			if err != nil {
-				return 0, errors.New("invalid content-length")
+				return 0, err
+			}
+
+			if n == 0 {
+				return totalBytesConsumed, nil
+			}
+
+			totalBytesConsumed += n
+
+			if chunkSize == 0 {
+				r.Status = ParsingTrailers
+				continue
+			}
+
+			if r.bodyRead+chunkSize > r.limits.MaxBodyBytes {
+				return 0, ErrBodyTooLarge
 			}
 
+			r.chunkRemaining = chunkSize
+			r.Status = ParsingChunkData
+		case ParsingChunkData:
+			remaining := data[totalBytesConsumed:]
+
 			if len(remaining) == 0 {
-				return 0, nil
+				return totalBytesConsumed, nil
+			}
+
+			needed := r.chunkRemaining
+			if needed > len(remaining) {
+				needed = len(remaining)
+			}
+
+			r.pending = append(r.pending, remaining[:needed]...)
+			r.bodyRead += needed
+			r.chunkRemaining -= needed
+			totalBytesConsumed += needed
+
+			if r.chunkRemaining == 0 {
+				r.Status = ParsingChunkDataEnd
 			}
+		case ParsingChunkDataEnd:
+			remaining := data[totalBytesConsumed:]
 
-			r.Body = append(r.Body, remaining...)
-			totalBytesConsumed += len(remaining)
+			if len(remaining) < len(crlf) {
+				return totalBytesConsumed, nil
+			}
 
-			if len(r.Body) > contentLength {
-				return 0, errors.New(fmt.Sprintf("body exceeds content-length. Expected size %d, got %d", contentLength, len(r.Body)))
+			if string(remaining[:len(crlf)]) != crlf {
+				return 0, fmt.Errorf("%w: missing CRLF after chunk data", ErrMalformedChunk)
 			}
 
-			if len(r.Body) == contentLength {
-				r.Status = Done
+			totalBytesConsumed += len(crlf)
+			r.Status = ParsingChunkSize
+		case ParsingTrailers:
+			n, done, err := r.Trailers.ParseWithOptions(data[totalBytesConsumed:], r.headerOptions)
+
+			if err != nil {
+				return 0, err
 			}
 
-			return totalBytesConsumed, nil
+			if err := r.checkHeaderLimits(data[totalBytesConsumed:], n, done); err != nil {
+				return 0, err
+			}
+
+			if n == 0 {
+				return totalBytesConsumed, nil
+			}
+
+			totalBytesConsumed += n
+
+			if done {
+				if err := r.checkTrailers(); err != nil {
+					return 0, err
+				}
+
+				r.Status = Done
+				return totalBytesConsumed, nil
+			}
 		}
 
 	}
@@ -112,57 +339,237 @@ func (r *Request) parse(data []byte) (int, error) {
 	return -1, errors.New("unknown error")
 }
 
+// checkHeaderLimits accounts for a header or trailer line of n bytes taken
+// from data. When the line is not complete yet (n is 0), it checks that the
+// bytes waiting for it don't already exceed what is left of the budget.
+func (r *Request) checkHeaderLimits(data []byte, n int, done bool) error {
+	if n == 0 {
+		if r.headerBytes+len(data) > r.limits.MaxHeaderBytes {
+			return ErrHeaderTooLarge
+		}
+		return nil
+	}
+
+	r.headerBytes += n
+	if r.headerBytes > r.limits.MaxHeaderBytes {
+		return ErrHeaderTooLarge
+	}
+
+	if !done {
+		r.headerCount++
+		if r.headerCount > r.limits.MaxHeaderCount {
+			return ErrTooManyHeaders
+		}
+	}
+
+	return nil
+}
+
 const bufferSize = 8
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
+const crlf = "\r\n"
+
+// parseChunkSize parses a chunk-size line, checking but otherwise ignoring any
+// chunk extensions. It returns 0 bytes consumed when the line is not complete
+// yet, and
+// ErrChunkLineTooLong once it is longer than maxChunkLineBytes.
+func parseChunkSize(data []byte) (int, int, error) {
+	if len(data) > maxChunkLineBytes {
+		data = data[:maxChunkLineBytes]
+	}
+
+	str := string(data)
+	dIndex := strings.Index(str, crlf)
+
+	if dIndex == -1 {
+		if len(data) == maxChunkLineBytes {
+			return 0, 0, ErrChunkLineTooLong
+		}
+		return 0, 0, nil
+	}
+
+	line := str[:dIndex]
+	sizeEnd := 0
+	for sizeEnd < len(line) && isHex(line[sizeEnd]) {
+		sizeEnd++
+	}
+	sizeStr, ext := line[:sizeEnd], line[sizeEnd:]
+
+	if sizeStr == "" {
+		return 0, 0, fmt.Errorf("%w: missing chunk size in %q", ErrMalformedChunk, line)
+	}
+
+	if !validChunkExt(ext) {
+		return 0, 0, fmt.Errorf("%w: invalid chunk extension %q", ErrMalformedChunk, ext)
+	}
+
+	chunkSize, err := strconv.ParseInt(sizeStr, 16, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid chunk size %s", ErrMalformedChunk, sizeStr)
+	}
 
-	request := Request{
-		Status:  Initialized,
-		Headers: headers.NewHeaders(),
+	return int(chunkSize), dIndex + len(crlf), nil
+}
+
+// Reader parses successive requests from a single connection. Bytes read past
+// the end of one request are kept and used for the next, so pipelined
+// requests arriving in the same read are not lost.
+type Reader struct {
+	// Limits applied to every request read. The zero value uses the defaults.
+	Limits Limits
+	// RejectEncodedSlashes refuses targets whose path contains "%2F", for
+	// applications where a decoded slash could be mistaken for a separator.
+	RejectEncodedSlashes bool
+	// UnfoldObsFold accepts header fields continued on a line starting with
+	// whitespace, instead of rejecting them with headers.ErrObsFold.
+	UnfoldObsFold bool
+	// Strict refuses requests that are valid but framed in ways that
+	// intermediaries are known to disagree on: repeated Content-Length
+	// values, Transfer-Encoding other than a single "chunked", framing fields
+	// in trailers, and obsolete line folding even if UnfoldObsFold is set.
+	Strict bool
+
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, bufferSize),
+	}
+}
+
+// ReadRequest returns the next request on the connection, with its body
+// buffered in Body. It returns io.EOF when the connection is closed cleanly
+// between requests.
+func (r *Reader) ReadRequest() (*Request, error) {
+	request, err := r.ReadRequestHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.ReadBody(request); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// ReadRequestHeader reads the next request up to the end of its header
+// section, so callers can act on the headers before the body arrives. The
+// body is then read from the request's BodyReader, or buffered with ReadBody.
+// Either way it has to be consumed, e.g. with DiscardBody, before the next
+// request can be read.
+func (r *Reader) ReadRequestHeader() (*Request, error) {
+	request := &Request{
+		Status:   Initialized,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		limits:   r.Limits.withDefaults(),
+
+		rejectEncodedSlashes: r.RejectEncodedSlashes,
+		strict:               r.Strict,
+		headerOptions:        headers.ParseOptions{UnfoldObsFold: r.UnfoldObsFold && !r.Strict},
+	}
+
+	err := r.readUntil(request, func() bool {
+		return request.Status >= ParsingBody
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Status < ParsingBody {
+		if request.Status == Initialized && r.readToIndex == 0 {
+			return nil, io.EOF
+		}
+
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	request.BodyReader = &bodyReader{reader: r, request: request}
+	return request, nil
+}
+
+// ReadBody reads the rest of the body of a request returned by
+// ReadRequestHeader into its Body. BodyReader is replaced with a reader over
+// the buffered body.
+func (r *Reader) ReadBody(request *Request) error {
+	body, err := io.ReadAll(&bodyReader{reader: r, request: request})
+	if err != nil {
+		return err
+	}
+
+	request.Body = body
+	request.BodyReader = io.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// DiscardBody reads and drops what is left of the body of a request returned
+// by ReadRequestHeader, so the next request can be read. It gives up with
+// ErrBodyTooLarge when more than max bytes are left, without reading them if
+// the Content-Length tells, and the connection can't be reused then.
+func (r *Reader) DiscardBody(request *Request, max int) error {
+	if request.UnreadBodyLength() > max {
+		return fmt.Errorf("%w: more than %d bytes left unread", ErrBodyTooLarge, max)
+	}
+
+	_, err := io.CopyN(io.Discard, &bodyReader{reader: r, request: request}, int64(max)+1)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
 	}
 
-	for request.Status != Done {
-		if readToIndex > 0 {
-			parsed, perr := request.parse(buf[:readToIndex])
+	return fmt.Errorf("%w: more than %d bytes left unread", ErrBodyTooLarge, max)
+}
+
+// readUntil feeds buffered and newly read bytes to the request parser until
+// done reports true or the connection reaches EOF.
+func (r *Reader) readUntil(request *Request, done func() bool) error {
+	for !done() {
+		if r.readToIndex > 0 {
+			parsed, perr := request.parse(r.buf[:r.readToIndex])
 			if perr != nil {
-				return nil, perr
+				return perr
 			}
 
 			if parsed > 0 {
-				copy(buf, buf[parsed:readToIndex])
-				readToIndex -= parsed
+				copy(r.buf, r.buf[parsed:r.readToIndex])
+				r.readToIndex -= parsed
 				continue
 			}
 		}
 
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+		if r.readToIndex >= len(r.buf) {
+			newBuf := make([]byte, len(r.buf)*2)
+			copy(newBuf, r.buf)
+			r.buf = newBuf
 		}
 
-		bytesRead, err := reader.Read(buf[readToIndex:])
+		bytesRead, err := r.reader.Read(r.buf[r.readToIndex:])
 		if err != nil && err != io.EOF {
-			return nil, err
+			return err
 		}
 
 		if bytesRead == 0 {
 			if err == io.EOF {
-				break
+				return nil
 			}
 			continue
 		}
 
-		readToIndex += bytesRead
+		r.readToIndex += bytesRead
 	}
 
-	if request.Body != nil && request.Status != Done {
-		return nil, errors.New("incomplete body")
-	}
+	return nil
+}
 
-	return &request, nil
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
 }
 
 func parseRequestLine(content string) (*RequestLine, int, error) {
@@ -179,7 +586,7 @@ func parseRequestLine(content string) (*RequestLine, int, error) {
 	parts := strings.Split(requestLineContent, " ")
 
 	if len(parts) != 3 {
-		return nil, 0, errors.New("invalid request line size")
+		return nil, 0, ErrMalformedRequestLine
 	}
 
 	method, target, httpVersion := parts[0], parts[1], parts[2]
@@ -187,21 +594,20 @@ func parseRequestLine(content string) (*RequestLine, int, error) {
 	isMethodValid := validateMethod(method)
 
 	if !isMethodValid {
-		return nil, 0, errors.New(fmt.Sprintf("invalid method %s", method))
+		return nil, 0, fmt.Errorf("%w: %s", ErrInvalidMethod, method)
 	}
 
-	isTargetValid := validateTarget(target)
+	httpVersion = strings.TrimSpace(httpVersion)
+	versionNumber, ok := strings.CutPrefix(httpVersion, "HTTP/")
 
-	if !isTargetValid {
-		return nil, 0, errors.New(fmt.Sprintf("invalid target %s", target))
+	if !ok || !isVersionNumber(versionNumber) {
+		return nil, 0, fmt.Errorf("%w: invalid version %s", ErrMalformedRequestLine, httpVersion)
 	}
 
-	versionNumber := strings.TrimSpace(strings.Split(httpVersion, "/")[1])
-
 	isValidVersion := validateVersion(versionNumber)
 
 	if !isValidVersion {
-		return nil, 0, errors.New(fmt.Sprintf("invalid version %s", httpVersion))
+		return nil, 0, fmt.Errorf("%w: %s", ErrUnsupportedVersion, httpVersion)
 	}
 
 	requestLine := RequestLine{
@@ -210,13 +616,23 @@ func parseRequestLine(content string) (*RequestLine, int, error) {
 		Method:        method,
 	}
 
+	if err := parseTarget(method, target, &requestLine); err != nil {
+		return nil, 0, err
+	}
+
 	return &requestLine, len(requestLineContent), nil
 }
 
+// validateMethod checks that s is a method token, 1*tchar. Methods are case
+// sensitive, so a lowercase token is a method of its own rather than a typo
+// to refuse; what a method means is left to the handlers.
 func validateMethod(s string) bool {
+	if s == "" {
+		return false
+	}
 
-	for _, r := range s {
-		if !unicode.IsUpper(r) && unicode.IsLetter(r) {
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
 			return false
 		}
 	}
@@ -224,14 +640,21 @@ func validateMethod(s string) bool {
 	return true
 }
 
-func validateTarget(s string) bool {
-
-	return strings.HasPrefix(s, "/")
+// isVersionNumber reports whether s has the DIGIT "." DIGIT shape of an
+// HTTP-version number.
+func isVersionNumber(s string) bool {
+	return len(s) == 3 &&
+		s[0] >= '0' && s[0] <= '9' &&
+		s[1] == '.' &&
+		s[2] >= '0' && s[2] <= '9'
 }
 
+// validateVersion accepts the HTTP/1.x versions this server speaks. Anything
+// else, including HTTP/2 and later which can't be used on this transport, is
+// answered with 505.
 func validateVersion(s string) bool {
 
-	return s == "1.1"
+	return s == "1.1" || s == "1.0"
 }
 
 func getLinesChannel(f io.Reader) <-chan string {
@@ -1,13 +1,22 @@
 package request
 
 import (
+	"context"
+	"httpfromtcp/internal/headers"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// headerValue returns the combined value of key, or "" if it is missing.
+func headerValue(h *headers.Headers, key string) string {
+	value, _ := h.Get(key)
+	return value
+}
+
 type chunkReader struct {
 	data            string
 	numBytesPerRead int
@@ -77,6 +86,64 @@ func TestRequestLineParse(t *testing.T) {
 	assert.Equal(t, "POST", r.RequestLine.Method)
 	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
+
+	// Test: Good HTTP/1.0 Request line without Host
+	reader = &chunkReader{
+		data:            "GET /coffee HTTP/1.0\r\nUser-Agent: probe/1.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 asking for keep-alive
+	reader = &chunkReader{
+		data:            "GET /coffee HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: HTTP/1.1 is persistent unless asked to close
+	reader = &chunkReader{
+		data:            "GET /coffee HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// Test: Expect: 100-continue is seen before the body is read
+	bodyReader := NewReader(&chunkReader{
+		data:            "PUT /coffee HTTP/1.1\r\nHost: localhost\r\nExpect: 100-Continue\r\nContent-Length: 4\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err = bodyReader.ReadRequestHeader()
+	require.NoError(t, err)
+	assert.True(t, r.ExpectContinue())
+	assert.NotEqual(t, Done, r.Status)
+
+	// Test: HTTP/1.0 expectations are ignored
+	reader = &chunkReader{
+		data:            "PUT /coffee HTTP/1.0\r\nExpect: 100-continue\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.False(t, r.ExpectContinue())
+
+	// Test: Methods are left to handlers, whatever the token
+	for _, method := range []string{"PROPFIND", "PURGE", "TRACE", "BREW", "M-SEARCH", "get"} {
+		r, err = RequestFromReader(&chunkReader{
+			data:            method + " / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			numBytesPerRead: 3,
+		})
+		require.NoError(t, err, method)
+		assert.Equal(t, method, r.RequestLine.Method)
+	}
 }
 
 func TestHeaderParsing(t *testing.T) {
@@ -89,7 +156,7 @@ func TestHeaderParsing(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, 0, len(r.Headers))
+	assert.Equal(t, 0, r.Headers.Len())
 
 	// Test: Standard Headers
 	reader = &chunkReader{
@@ -99,9 +166,9 @@ func TestHeaderParsing(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", headerValue(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", headerValue(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", headerValue(r.Headers, "accept"))
 
 	// Test: Multipe Headers with one Malformed
 	reader = &chunkReader{
@@ -128,7 +195,7 @@ func TestHeaderParsing(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "lane-loves-go, prime-loves-zig, tj-loves-ocaml", r.Headers["set-person"])
+	assert.Equal(t, "lane-loves-go, prime-loves-zig, tj-loves-ocaml", headerValue(r.Headers, "set-person"))
 }
 
 func TestRequestBody(t *testing.T) {
@@ -171,3 +238,570 @@ func TestRequestBody(t *testing.T) {
 	require.NotNil(t, r)
 	assert.Equal(t, "", string(r.Body))
 }
+
+func TestReaderPipelining(t *testing.T) {
+	// Test: Two pipelined requests in the same stream
+	reader := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 64,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Equal(t, "localhost:42069", headerValue(r.Headers, "host"))
+
+	// Test: Clean EOF after the last request
+	r, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.EOF)
+	require.Nil(t, r)
+
+	// Test: Pipelined requests with small reads
+	reader = NewReader(&chunkReader{
+		data:            "GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\nGET /c HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	for _, target := range []string{"/a", "/b", "/c"} {
+		r, err = reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, target, r.RequestLine.RequestTarget)
+	}
+
+	// Test: Connection closed in the middle of the headers
+	reader = NewReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: local",
+		numBytesPerRead: 3,
+	})
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestStreamingBody(t *testing.T) {
+	// Test: Content-Length body streamed after the headers
+	reader := NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	})
+	r, err := reader.ReadRequestHeader()
+	require.NoError(t, err)
+	assert.Nil(t, r.Body)
+	buf := make([]byte, 4)
+	n, err := r.BodyReader.Read(buf)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, n, 4)
+	rest, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(buf[:n])+string(rest))
+
+	// Test: chunked body streamed with its trailers
+	reader = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: 42\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+	assert.Equal(t, "42", headerValue(r.Trailers, "X-Sum"))
+
+	// Test: an unread body is discarded before the next request
+	reader = NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	require.NoError(t, r.BodyReader.Close())
+	_, err = r.BodyReader.Read(buf)
+	require.ErrorIs(t, err, ErrBodyClosed)
+	require.NoError(t, reader.DiscardBody(r, DefaultMaxBodyBytes))
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+
+	// Test: a Content-Length over the discard limit is refused without reading
+	reader = NewReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1000\r\n\r\nabc",
+		numBytesPerRead: 3,
+	})
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	assert.Equal(t, 1000, r.UnreadBodyLength())
+	require.ErrorIs(t, reader.DiscardBody(r, 100), ErrBodyTooLarge)
+
+	// Test: so is a chunked body, once the limit is read
+	reader = NewReader(&chunkReader{
+		data: "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	assert.Equal(t, -1, r.UnreadBodyLength())
+	require.ErrorIs(t, reader.DiscardBody(r, 8), ErrBodyTooLarge)
+
+	// Test: a body right at the limit is discarded
+	reader = NewReader(&chunkReader{
+		data: "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	require.NoError(t, reader.DiscardBody(r, 10))
+
+	// Test: body errors surface on read
+	reader = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\nzz\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	require.ErrorIs(t, err, ErrMalformedChunk)
+	require.ErrorIs(t, reader.DiscardBody(r, DefaultMaxBodyBytes), ErrMalformedChunk)
+
+	// Test: a truncated body reports ErrIncompleteBody
+	reader = NewReader(&chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nab",
+		numBytesPerRead: 3,
+	})
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	require.ErrorIs(t, err, ErrIncompleteBody)
+}
+
+func TestChunkedRequestBody(t *testing.T) {
+	// Test: Standard chunked body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\n" +
+			"hello \r\n" +
+			"7\r\n" +
+			"world!\n\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, 0, r.Trailers.Len())
+
+	// Test: Chunk extensions and upper case hex sizes
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"A;name=value\r\n" +
+			"0123456789\r\n" +
+			"0;last\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "0123456789", string(r.Body))
+
+	// Test: Trailer fields are kept apart from the headers
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"X-Checksum: def456\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.Equal(t, "abc123, def456", headerValue(r.Trailers, "x-checksum"))
+	_, ok := r.Headers.Get("X-Checksum")
+	assert.False(t, ok)
+
+	// Test: Chunked request followed by a pipelined request
+	pipelined := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n" +
+			"GET /second HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 64,
+	})
+	r, err = pipelined.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(r.Body))
+	r, err = pipelined.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Chunk data longer than its size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Missing last-chunk
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+}
+
+func TestRequestLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineBytes: 32,
+		MaxHeaderBytes:      64,
+		MaxHeaderCount:      2,
+		MaxBodyBytes:        8,
+	}
+
+	// Test: Request within all limits
+	reader := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 8\r\n" +
+			"\r\n" +
+			"12345678",
+		numBytesPerRead: 3,
+	})
+	reader.Limits = limits
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "12345678", string(r.Body))
+
+	// Test: Request line too long, without waiting for its end
+	reader = NewReader(&chunkReader{
+		data:            "GET /" + strings.Repeat("a", 64),
+		numBytesPerRead: 3,
+	})
+	reader.Limits = limits
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Header section too large
+	reader = NewReader(&chunkReader{
+		data: "GET / HTTP/1.1\r\n" +
+			"X-Big: " + strings.Repeat("a", 80) + "\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	})
+	reader.Limits = limits
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Too many header fields
+	reader = NewReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	reader.Limits = limits
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrTooManyHeaders)
+
+	// Test: Content-Length over the body limit
+	reader = NewReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n123456789",
+		numBytesPerRead: 3,
+	})
+	reader.Limits = limits
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Chunked body growing over the body limit
+	reader = NewReader(&chunkReader{
+		data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\n12345\r\n5\r\n67890\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	reader.Limits = limits
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: An endless chunk extension is cut off before it fills memory
+	reader = NewReader(&endlessReader{
+		prefix: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1;",
+		fill:   'a',
+	})
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrChunkLineTooLong)
+	assert.LessOrEqual(t, len(reader.buf), 4*maxChunkLineBytes)
+
+	// Test: A chunk-size line right at the limit is accepted
+	ext := ";" + strings.Repeat("a", maxChunkLineBytes-len("1;\r\n"))
+	r, err = RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1" + ext + "\r\nx\r\n0\r\n\r\n",
+		numBytesPerRead: 1024,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "x", string(r.Body))
+}
+
+// endlessReader returns prefix followed by fill forever.
+type endlessReader struct {
+	prefix string
+	fill   byte
+}
+
+func (e *endlessReader) Read(p []byte) (int, error) {
+	n := copy(p, e.prefix)
+	e.prefix = e.prefix[n:]
+	for i := n; i < len(p); i++ {
+		p[i] = e.fill
+	}
+	return len(p), nil
+}
+
+func TestRequestErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"Malformed request line", "GET /\r\n\r\n", ErrMalformedRequestLine},
+		{"Empty method", " / HTTP/1.1\r\n\r\n", ErrInvalidMethod},
+		{"Control byte in method", "G\x01T / HTTP/1.1\r\n\r\n", ErrInvalidMethod},
+		{"Non-ASCII method", "GÉT / HTTP/1.1\r\n\r\n", ErrInvalidMethod},
+		{"Invalid target", "GET coffee HTTP/1.1\r\n\r\n", ErrInvalidTarget},
+		{"Unsupported version", "GET / HTTP/1.2\r\n\r\n", ErrUnsupportedVersion},
+		{"HTTP/2 on this transport", "GET / HTTP/2.0\r\n\r\n", ErrUnsupportedVersion},
+		{"HTTP/2 connection preface", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", ErrUnsupportedVersion},
+		{"Missing version", "GET / coffee\r\n\r\n", ErrMalformedRequestLine},
+		{"Malformed version", "GET / HTTP/one\r\n\r\n", ErrMalformedRequestLine},
+		{"Malformed header", "GET / HTTP/1.1\r\nHost localhost\r\n\r\n", headers.ErrMalformedHeader},
+		{"Invalid field-name", "GET / HTTP/1.1\r\nH©st: localhost\r\n\r\n", headers.ErrInvalidFieldName},
+		{"Invalid field-value", "GET / HTTP/1.1\r\nHost: local\x00host\r\n\r\n", headers.ErrInvalidFieldValue},
+		{"Obsolete line folding", "GET / HTTP/1.1\r\nHost: localhost\r\n :42069\r\n\r\n", headers.ErrObsFold},
+		{"Bad content-length", "POST / HTTP/1.1\r\nContent-Length: ten\r\n\r\n", ErrBadContentLength},
+		{"Unsupported transfer-encoding", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", ErrUnsupportedTransferEncoding},
+		{"Malformed chunk", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nxyz\r\n", ErrMalformedChunk},
+		{"Incomplete body", "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nab", ErrIncompleteBody},
+	}
+
+	for _, c := range cases {
+		// Test: each failure is reported with its typed error
+		_, err := RequestFromReader(&chunkReader{data: c.data, numBytesPerRead: 3})
+		assert.ErrorIs(t, err, c.err, c.name)
+	}
+}
+
+func TestRequestTargetForms(t *testing.T) {
+	// Test: origin-form with a query
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET /where?q=now HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, OriginForm, r.RequestLine.Form)
+	assert.Equal(t, "/where", r.RequestLine.RawPath)
+	assert.Equal(t, "q=now", r.RequestLine.RawQuery)
+
+	// Test: absolute-form sent to a proxy
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET HTTP://www.example.org:8080/pub/WWW/?a=1 HTTP/1.1\r\nHost: www.example.org\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, AbsoluteForm, r.RequestLine.Form)
+	assert.Equal(t, "http", r.RequestLine.Scheme)
+	assert.Equal(t, "www.example.org:8080", r.RequestLine.Authority)
+	assert.Equal(t, "/pub/WWW/", r.RequestLine.RawPath)
+	assert.Equal(t, "a=1", r.RequestLine.RawQuery)
+
+	// Test: absolute-form without a path
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET http://example.org HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "example.org", r.RequestLine.Authority)
+	assert.Equal(t, "/", r.RequestLine.RawPath)
+
+	// Test: authority-form with CONNECT
+	r, err = RequestFromReader(&chunkReader{
+		data:            "CONNECT www.example.com:443 HTTP/1.1\r\nHost: www.example.com:443\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, AuthorityForm, r.RequestLine.Form)
+	assert.Equal(t, "www.example.com:443", r.RequestLine.Authority)
+
+	// Test: asterisk-form with OPTIONS
+	r, err = RequestFromReader(&chunkReader{
+		data:            "OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, AsteriskForm, r.RequestLine.Form)
+
+	// Test: forms used with the wrong method
+	for _, data := range []string{
+		"GET * HTTP/1.1\r\n\r\n",
+		"GET www.example.com:443 HTTP/1.1\r\n\r\n",
+		"CONNECT /tunnel HTTP/1.1\r\n\r\n",
+		"CONNECT www.example.com HTTP/1.1\r\n\r\n",
+		"CONNECT http://www.example.com:443/ HTTP/1.1\r\n\r\n",
+		"GET http:///path HTTP/1.1\r\n\r\n",
+		"GET /a#fragment HTTP/1.1\r\n\r\n",
+	} {
+		_, err = RequestFromReader(&chunkReader{data: data, numBytesPerRead: 3})
+		assert.ErrorIs(t, err, ErrInvalidTarget, data)
+	}
+}
+
+func TestRequestPathAndQuery(t *testing.T) {
+	cases := map[string]string{
+		"/":                   "/",
+		"/coffee":             "/coffee",
+		"/coffee/":            "/coffee/",
+		"/a//b///c":           "/a/b/c",
+		"/a/./b/../c":         "/a/c",
+		"/a/b/..":             "/a/",
+		"/../../etc/passwd":   "/etc/passwd",
+		"/a/%2e%2e/%2E%2E/b":  "/b",
+		"/caf%C3%A9/hello%20": "/café/hello ",
+		"/a%2Fb":              "/a/b",
+	}
+
+	for target, path := range cases {
+		// Test: the path is decoded and normalized
+		r, err := RequestFromReader(&chunkReader{
+			data:            "GET " + target + " HTTP/1.1\r\n\r\n",
+			numBytesPerRead: 3,
+		})
+		require.NoError(t, err, target)
+		assert.Equal(t, path, r.Path, target)
+	}
+
+	// Test: absolute-form targets get a path too
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET http://example.org/a/../b HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.Path)
+
+	// Test: invalid escapes and NUL are rejected
+	for _, target := range []string{"/a%zzb", "/a%2", "/a%00b"} {
+		_, err = RequestFromReader(&chunkReader{
+			data:            "GET " + target + " HTTP/1.1\r\n\r\n",
+			numBytesPerRead: 3,
+		})
+		assert.ErrorIs(t, err, ErrInvalidTarget, target)
+	}
+
+	// Test: encoded slashes can be rejected
+	reader := NewReader(&chunkReader{
+		data:            "GET /a%2fb HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	reader.RejectEncodedSlashes = true
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, ErrInvalidTarget)
+
+	// Test: multi-valued, decoded query
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET /search?q=go+lang&tag=a&tag=b%26c&empty=&flag&bad=%zz HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	query := r.Query()
+	assert.Equal(t, "go lang", query.Get("q"))
+	assert.Equal(t, []string{"a", "b&c"}, query["tag"])
+	assert.True(t, query.Has("empty"))
+	assert.True(t, query.Has("flag"))
+	assert.False(t, query.Has("bad"))
+	assert.Equal(t, "", query.Get("missing"))
+}
+
+func TestRequestContext(t *testing.T) {
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+
+	// Test: a request without a context uses the background one
+	assert.Equal(t, context.Background(), r.Context())
+
+	// Test: WithContext returns a copy, leaving the original untouched
+	type key struct{}
+	r2 := r.WithContext(context.WithValue(context.Background(), key{}, "value"))
+	assert.Equal(t, "value", r2.Context().Value(key{}))
+	assert.Nil(t, r.Context().Value(key{}))
+	assert.Same(t, r.Headers, r2.Headers)
+}
@@ -0,0 +1,226 @@
+package request
+
+import (
+	"httpfromtcp/internal/headers"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// smugglingCase is a request whose framing a front-end and a back-end could
+// read differently. body is what the request must parse to when err is nil.
+type smugglingCase struct {
+	name   string
+	data   string
+	err    error
+	strict error
+	body   string
+}
+
+var smugglingCorpus = []smugglingCase{
+	{
+		name: "CL.TE: both headers",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"0\r\n\r\nG",
+		err: ErrAmbiguousLength,
+	},
+	{
+		name: "TE.CL: both headers, TE first",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n" +
+			"8\r\nSMUGGLED\r\n0\r\n\r\n",
+		err: ErrAmbiguousLength,
+	},
+	{
+		name: "Conflicting Content-Length fields",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 5\r\n\r\nabcde",
+		err:  ErrAmbiguousLength,
+	},
+	{
+		name: "Conflicting Content-Length list",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3, 5\r\n\r\nabcde",
+		err:  ErrAmbiguousLength,
+	},
+	{
+		name:   "Repeated identical Content-Length fields",
+		data:   "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc",
+		strict: ErrAmbiguousLength,
+		body:   "abc",
+	},
+	{
+		name:   "Identical Content-Length list",
+		data:   "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3,3\r\n\r\nabc",
+		strict: ErrAmbiguousLength,
+		body:   "abc",
+	},
+	{
+		name: "Negative Content-Length",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n",
+		err:  ErrBadContentLength,
+	},
+	{
+		name: "Signed Content-Length",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +3\r\n\r\nabc",
+		err:  ErrBadContentLength,
+	},
+	{
+		name: "Hexadecimal Content-Length",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0x3\r\n\r\nabc",
+		err:  ErrBadContentLength,
+	},
+	{
+		name: "Content-Length with inner space",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1 2\r\n\r\n",
+		err:  ErrBadContentLength,
+	},
+	{
+		name: "Empty Content-Length",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: \r\n\r\n",
+		err:  ErrBadContentLength,
+	},
+	{
+		name: "Content-Length overflowing int64",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999999999999999999\r\n\r\n",
+		err:  ErrBodyTooLarge,
+	},
+	{
+		name: "Content-Length with leading zeros",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 003\r\n\r\nabc",
+		body: "abc",
+	},
+	{
+		name: "Chunked not the final coding",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, identity\r\n\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n",
+		err: ErrInvalidTransferEncoding,
+	},
+	{
+		name: "Chunked applied twice",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n",
+		err: ErrInvalidTransferEncoding,
+	},
+	{
+		name: "Unknown coding before chunked",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n",
+		err:    ErrUnsupportedTransferEncoding,
+		strict: ErrInvalidTransferEncoding,
+	},
+	{
+		name: "Obfuscated chunked",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n",
+		err:    ErrUnsupportedTransferEncoding,
+		strict: ErrInvalidTransferEncoding,
+	},
+	{
+		name: "Chunked with an empty list element",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: , chunked\r\n\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n",
+		strict: ErrInvalidTransferEncoding,
+		body:   "abc",
+	},
+	{
+		name: "Chunked in mixed case",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: ChUnKeD\r\n\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n",
+		body: "abc",
+	},
+	{
+		name:   "Empty Transfer-Encoding",
+		data:   "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: \r\n\r\n",
+		err:    ErrInvalidTransferEncoding,
+		strict: ErrInvalidTransferEncoding,
+	},
+	{
+		name: "Transfer-Encoding in HTTP/1.0",
+		data: "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n",
+		err: ErrInvalidTransferEncoding,
+	},
+	{
+		name: "Space before the colon",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\n\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n",
+		err: headers.ErrInvalidFieldName,
+	},
+	{
+		name: "Transfer-Encoding hidden in a folded line",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nX-Foo: bar\r\n Transfer-Encoding: chunked\r\n\r\n",
+		err:  headers.ErrObsFold,
+	},
+	{
+		name: "Bare LF in a chunk extension",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3;\nxx\r\nabc\r\n0\r\n\r\n",
+		err: ErrMalformedChunk,
+	},
+	{
+		name: "Bare LF after the chunk size",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3\nxx\r\nabc\r\n0\r\n\r\n",
+		err: ErrMalformedChunk,
+	},
+	{
+		name: "Control character in a quoted chunk extension",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3;a=\"\x01\"\r\nabc\r\n0\r\n\r\n",
+		err: ErrMalformedChunk,
+	},
+	{
+		name: "Unterminated quoted chunk extension",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3;a=\"abc\r\nabc\r\n0\r\n\r\n",
+		err: ErrMalformedChunk,
+	},
+	{
+		name: "Well-formed chunk extensions",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3;flag ; name = value;q=\"a \\\"b\\\";c\"\r\nabc\r\n0;last\r\n\r\n",
+		body: "abc",
+	},
+	{
+		name: "Content-Length in trailers",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3\r\nabc\r\n0\r\nContent-Length: 10\r\n\r\n",
+		strict: ErrForbiddenTrailer,
+		body:   "abc",
+	},
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	for _, c := range smugglingCorpus {
+		for _, strict := range []bool{false, true} {
+			want := c.err
+			if strict && c.strict != nil {
+				want = c.strict
+			}
+
+			// Test: the request is refused with the expected error, or
+			// parsed to the expected body
+			reader := NewReader(&chunkReader{data: c.data, numBytesPerRead: 3})
+			reader.Strict = strict
+			r, err := reader.ReadRequest()
+
+			if want != nil {
+				assert.ErrorIs(t, err, want, "%s (strict: %v)", c.name, strict)
+				continue
+			}
+
+			if assert.NoError(t, err, "%s (strict: %v)", c.name, strict) {
+				assert.Equal(t, c.body, string(r.Body), "%s (strict: %v)", c.name, strict)
+			}
+		}
+	}
+
+	// Test: strict mode ignores UnfoldObsFold
+	reader := NewReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: a\r\nX-Foo: bar\r\n baz\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	reader.UnfoldObsFold = true
+	reader.Strict = true
+	_, err := reader.ReadRequest()
+	require.ErrorIs(t, err, headers.ErrObsFold)
+}
@@ -0,0 +1,137 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TargetForm is one of the four request-target forms of RFC 9112 section 3.2.
+type TargetForm int
+
+const (
+	// OriginForm is an absolute path with an optional query, "/where?q=now",
+	// used for requests sent directly to the origin server.
+	OriginForm TargetForm = iota
+	// AbsoluteForm is a full URI, "http://example.com/where?q=now", used for
+	// requests sent through a forward proxy.
+	AbsoluteForm
+	// AuthorityForm is "host:port", only used by CONNECT.
+	AuthorityForm
+	// AsteriskForm is "*", only used by a server-wide OPTIONS.
+	AsteriskForm
+)
+
+func (f TargetForm) String() string {
+	switch f {
+	case OriginForm:
+		return "origin-form"
+	case AbsoluteForm:
+		return "absolute-form"
+	case AuthorityForm:
+		return "authority-form"
+	case AsteriskForm:
+		return "asterisk-form"
+	default:
+		return fmt.Sprintf("TargetForm(%d)", int(f))
+	}
+}
+
+// parseTarget splits target into the RequestLine fields describing it and
+// checks that method is allowed to use its form.
+func parseTarget(method string, target string, requestLine *RequestLine) error {
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] >= 0x7f || target[i] == '#' {
+			return fmt.Errorf("%w: %s", ErrInvalidTarget, target)
+		}
+	}
+
+	switch {
+	case method == "CONNECT":
+		if !isAuthority(target) {
+			return fmt.Errorf("%w: CONNECT requires host:port, got %s", ErrInvalidTarget, target)
+		}
+		requestLine.Form = AuthorityForm
+		requestLine.Authority = target
+		return nil
+	case target == "*":
+		if method != "OPTIONS" {
+			return fmt.Errorf("%w: * is only allowed with OPTIONS", ErrInvalidTarget)
+		}
+		requestLine.Form = AsteriskForm
+		return nil
+	case strings.HasPrefix(target, "/"):
+		requestLine.Form = OriginForm
+		requestLine.RawPath, requestLine.RawQuery, _ = strings.Cut(target, "?")
+		return nil
+	}
+
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || !isScheme(scheme) {
+		return fmt.Errorf("%w: %s", ErrInvalidTarget, target)
+	}
+
+	authority := rest
+	pathAndQuery := ""
+	if i := strings.IndexAny(rest, "/?"); i != -1 {
+		authority, pathAndQuery = rest[:i], rest[i:]
+	}
+
+	if authority == "" {
+		return fmt.Errorf("%w: missing authority in %s", ErrInvalidTarget, target)
+	}
+
+	requestLine.Form = AbsoluteForm
+	requestLine.Scheme = strings.ToLower(scheme)
+	requestLine.Authority = authority
+	requestLine.RawPath, requestLine.RawQuery, _ = strings.Cut(pathAndQuery, "?")
+
+	if requestLine.RawPath == "" {
+		requestLine.RawPath = "/"
+	}
+
+	return nil
+}
+
+// isScheme reports whether s is a URI scheme: a letter followed by letters,
+// digits, "+", "-" or ".".
+func isScheme(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i, char := range s {
+		switch {
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z':
+			continue
+		case i > 0 && (char >= '0' && char <= '9' || char == '+' || char == '-' || char == '.'):
+			continue
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// isAuthority reports whether s is a "host:port" authority with a non-empty
+// host and a numeric port. IPv6 hosts are written in brackets.
+func isAuthority(s string) bool {
+	colon := strings.LastIndex(s, ":")
+	if colon < 1 || colon == len(s)-1 {
+		return false
+	}
+
+	host, port := s[:colon], s[colon+1:]
+
+	for _, char := range port {
+		if char < '0' || char > '9' {
+			return false
+		}
+	}
+
+	if strings.HasPrefix(host, "[") {
+		return strings.HasSuffix(host, "]")
+	}
+
+	return !strings.ContainsAny(host, "/?@[]:")
+}
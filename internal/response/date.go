@@ -0,0 +1,31 @@
+package response
+
+import (
+	"sync"
+	"time"
+)
+
+// TimeFormat is the IMF-fixdate format of RFC 9110 section 5.6.7, used for
+// Date, Last-Modified and other date fields. Times must be in UTC.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// dateCache holds the Date value of the current second, so busy servers
+// don't format the same date for every response.
+var dateCache struct {
+	mu    sync.Mutex
+	unix  int64
+	value string
+}
+
+// httpDate returns now formatted for a Date header.
+func httpDate(now time.Time) string {
+	dateCache.mu.Lock()
+	defer dateCache.mu.Unlock()
+
+	if unix := now.Unix(); unix != dateCache.unix || dateCache.value == "" {
+		dateCache.unix = unix
+		dateCache.value = now.UTC().Format(TimeFormat)
+	}
+
+	return dateCache.value
+}
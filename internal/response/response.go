@@ -2,65 +2,661 @@ package response
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
+	"io"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type StatusCode int
+// WriterState is the part of the response a Writer expects next. A response
+// is always written as status line, headers, body and, for chunked bodies,
+// trailers.
+type WriterState int
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StateStatusLine WriterState = iota
+	StateHeaders
+	StateBody
+	StateTrailers
+	StateDone
 )
 
+func (s WriterState) String() string {
+	switch s {
+	case StateStatusLine:
+		return "status line"
+	case StateHeaders:
+		return "headers"
+	case StateBody:
+		return "body"
+	case StateTrailers:
+		return "trailers"
+	case StateDone:
+		return "done"
+	default:
+		return fmt.Sprintf("WriterState(%d)", int(s))
+	}
+}
+
+// WriterStateError is returned when a part of the response is written out of
+// order, e.g. a second status line or headers after the body.
+type WriterStateError struct {
+	Op    string
+	State WriterState
+}
+
+func (e *WriterStateError) Error() string {
+	return fmt.Sprintf("response: cannot %s while writing %s", e.Op, e.State)
+}
+
+// Errors returned when a body doesn't match the Content-Length set for it, and
+// by Finish once a response has been aborted.
+var (
+	ErrBodyTooLong  = errors.New("response: body longer than its content-length")
+	ErrBodyTooShort = errors.New("response: body shorter than its content-length")
+	ErrNotChunked   = errors.New("response: chunked body after a content-length")
+	ErrAborted      = errors.New("response: aborted")
+)
+
+// Writer builds a response in Buffer. A Writer created with NewWriter is bound
+// to a connection: Flush sends whatever has been buffered so far, which lets
+// handlers stream large or never-ending bodies instead of holding them in
+// memory, and Finish sends the rest once the handler is done.
 type Writer struct {
 	Buffer *bytes.Buffer
+	conn   io.Writer
+	close  bool
+
+	version      string
+	state        WriterState
+	status       StatusCode
+	header       *headers.Headers
+	bytesWritten int
+
+	// pending holds a header section without Content-Length or
+	// Transfer-Encoding, which is written once the body is known to be
+	// complete or has to be sent, and bodyStart is where it goes in Buffer.
+	// chunked is set once the header section written says the body is
+	// chunked, so that WriteBody frames its bytes and Finish ends the body.
+	pending   *headers.Headers
+	bodyStart int
+	chunked   bool
+
+	// contentLength is the Content-Length the handler set, which the body
+	// written has to match, if hasLength is set.
+	contentLength int
+	hasLength     bool
+	aborted       bool
+
+	// head is set for responses to HEAD requests, and discard once the
+	// status or the request method rules out a body.
+	head    bool
+	discard bool
+
+	// closing, if set, reports whether the connection is about to be
+	// closed anyway, see SetClosing.
+	closing func() bool
+}
+
+func NewWriter(conn io.Writer) *Writer {
+	return &Writer{
+		Buffer: bytes.NewBuffer([]byte{}),
+		conn:   conn,
+	}
+}
+
+// Flush sends the buffered bytes to the connection. It is a no-op for a
+// Writer that is not bound to one. If the headers were written without a
+// Content-Length, flushing before the end of the body means the length can't
+// be known, so the body is sent chunked, or on HTTP/1.0 and closing
+// connections delimited by closing the connection.
+func (w *Writer) Flush() error {
+	if w.conn == nil {
+		return nil
+	}
+
+	if w.pending != nil {
+		if err := w.writePendingHeaders(false); err != nil {
+			return err
+		}
+	}
+
+	if w.Buffer.Len() == 0 {
+		return nil
+	}
+
+	_, err := w.Buffer.WriteTo(w.conn)
+	return err
+}
+
+// Finish completes the response and flushes it. A handler that wrote nothing
+// gets an empty 200 response, a body written without a Content-Length gets
+// one, and a chunked body whose trailers were never written is ended. A body
+// shorter than the Content-Length the handler set can't be completed, so the
+// response is aborted instead and ErrBodyTooShort returned.
+func (w *Writer) Finish() error {
+	if w.aborted {
+		return ErrAborted
+	}
+
+	switch w.state {
+	case StateStatusLine, StateHeaders:
+		if err := w.writeDefaults(0); err != nil {
+			return err
+		}
+	case StateBody:
+		if w.hasLength && w.bytesWritten < w.contentLength {
+			w.Abort()
+			return fmt.Errorf("%w: %d of %d bytes written", ErrBodyTooShort, w.bytesWritten, w.contentLength)
+		}
+	}
+
+	if w.pending != nil {
+		if err := w.writePendingHeaders(true); err != nil {
+			return err
+		}
+	}
+
+	switch w.state {
+	case StateBody:
+		if w.chunked {
+			if _, err := w.Buffer.Write([]byte("0\r\n\r\n")); err != nil {
+				return err
+			}
+		}
+	case StateTrailers:
+		if w.discard || !w.chunked {
+			break
+		}
+
+		if _, err := w.Buffer.Write([]byte("\r\n")); err != nil {
+			return err
+		}
+	}
+
+	w.state = StateDone
+	return w.Flush()
+}
+
+// Abort gives up on a response that can't be completed, e.g. because the
+// handler failed after starting it. Nothing more is sent, not even what is
+// still buffered, and the connection has to be closed: the client then sees a
+// truncated response rather than taking a partial body for a complete one. A
+// body delimited by the connection closing is the exception, since nothing
+// tells its end from a truncation.
+func (w *Writer) Abort() {
+	w.Buffer.Reset()
+	w.pending = nil
+	w.state = StateDone
+	w.close = true
+	w.aborted = true
+}
+
+// SetKeepAlive tells the writer whether the connection should stay open after
+// this response. When it should not, WriteHeaders adds "Connection: close".
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.close = !keepAlive
+}
+
+// SetClosing registers a function asked, when the header section is written,
+// whether the connection will be closed after this response regardless of
+// keep-alive, so "Connection: close" is still announced. The server uses it
+// for a shutdown that starts while the handler runs, and for a request body
+// the handler leaves too much of to skip.
+func (w *Writer) SetClosing(closing func() bool) {
+	w.closing = closing
 }
 
+// SetVersion sets the HTTP version of the response, "1.1" by default. The
+// server matches the version of the request, so HTTP/1.0 clients get an
+// HTTP/1.0 response.
+func (w *Writer) SetVersion(version string) {
+	w.version = version
+}
+
+// SetRequestMethod tells the writer the method of the request it answers.
+// For HEAD, the body the handler writes is counted for Content-Length but not
+// sent, so a handler written for GET answers HEAD correctly.
+func (w *Writer) SetRequestMethod(method string) {
+	w.head = method == "HEAD"
+}
+
+// KeepAlive reports whether the connection can be reused once this response
+// has been sent, taking into account any Connection header the handler wrote.
+func (w *Writer) KeepAlive() bool {
+	return !w.close
+}
+
+// Written reports whether any part of the response has been written.
+func (w *Writer) Written() bool {
+	return w.state != StateStatusLine
+}
+
+// Header returns headers that WriteHeaders adds to the response unless the
+// handler sets them itself. Middleware uses it to add fields to responses it
+// does not write.
+func (w *Writer) Header() *headers.Headers {
+	if w.header == nil {
+		w.header = headers.NewHeaders()
+	}
+
+	return w.header
+}
+
+// BytesWritten returns the number of body bytes written so far, not counting
+// chunk framing.
+func (w *Writer) BytesWritten() int {
+	return w.bytesWritten
+}
+
+// Status returns the status code written so far, or 0 if the status line has
+// not been written yet.
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// WriteStatusLine writes the status line of the final response. The reason
+// phrase is the one registered for statusCode, or empty if there is none.
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if !statusCode.IsValid() {
+		return fmt.Errorf("%w: %d", ErrInvalidStatusCode, statusCode)
+	}
+
+	if w.state != StateStatusLine {
+		return &WriterStateError{Op: "write status line", State: w.state}
+	}
+
+	w.state = StateHeaders
+	w.status = statusCode
+
+	return w.writeStatusLine(statusCode)
+}
+
+func (w *Writer) writeStatusLine(statusCode StatusCode) error {
 	httpVersion := "HTTP/1.1"
-	switch statusCode {
-	case StatusOK:
-		_, err := w.Buffer.Write([]byte(fmt.Sprintf("%s %d %s\r\n", httpVersion, StatusOK, "OK")))
+	if w.version != "" {
+		httpVersion = "HTTP/" + w.version
+	}
+
+	// The space before the reason phrase is required even when the
+	// phrase is empty.
+	_, err := w.Buffer.Write([]byte(fmt.Sprintf("%s %d %s\r\n", httpVersion, statusCode, StatusText(statusCode))))
+	return err
+}
+
+// WriteInformational sends an interim 1xx response, such as 100 Continue or
+// 103 Early Hints with Link headers, ahead of the final one. It is flushed
+// right away and can be called any number of times before WriteStatusLine.
+// HTTP/1.0 clients don't understand interim responses, so nothing is sent to
+// them.
+func (w *Writer) WriteInformational(statusCode StatusCode, h *headers.Headers) error {
+	if !statusCode.IsInformational() {
+		return fmt.Errorf("%w: %d is not informational", ErrInvalidStatusCode, statusCode)
+	}
+
+	if w.state != StateStatusLine {
+		return &WriterStateError{Op: "write informational response", State: w.state}
+	}
+
+	if w.version == "1.0" {
+		return nil
+	}
+
+	if err := w.writeStatusLine(statusCode); err != nil {
+		return err
+	}
+
+	if h != nil {
+		if _, err := h.WriteTo(w.Buffer); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.Buffer.Write([]byte("\r\n")); err != nil {
 		return err
-	case StatusBadRequest:
-		_, err := w.Buffer.Write([]byte(fmt.Sprintf("%s %d %s\r\n", httpVersion, StatusBadRequest, "Bad Request")))
+	}
+
+	return w.Flush()
+}
+
+// WriteHeaders writes the header section. If the status line has not been
+// written yet, a 200 status line is written first. A Date header is added
+// unless headers has one. If headers has neither Content-Length nor
+// Transfer-Encoding, the section is held back until the body is known, see
+// Flush and Finish.
+//
+// 1xx, 204 and 304 responses can't have a body: Content-Length and
+// Transfer-Encoding are removed from their headers and anything written to
+// their body is dropped, as is the body of a response to HEAD.
+//
+// HTTP/1.0 has no Transfer-Encoding either, so for HTTP/1.0 clients it is
+// removed too, chunks are sent as they are and trailers dropped, and the body
+// ends with the connection.
+func (w *Writer) WriteHeaders(headers *headers.Headers) error {
+	if w.state == StateStatusLine {
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			return err
+		}
+	}
+
+	if w.state != StateHeaders {
+		return &WriterStateError{Op: "write headers", State: w.state}
+	}
+
+	w.state = StateBody
+
+	if w.header != nil {
+		// Fields the handler set win over every instance of the same
+		// name in Header, while repeated ones like Set-Cookie are all
+		// kept.
+		set := map[string]bool{}
+		headers.Range(func(name string, value string) bool {
+			set[strings.ToLower(name)] = true
+			return true
+		})
+
+		w.header.Range(func(name string, value string) bool {
+			if !set[strings.ToLower(name)] {
+				headers.Add(name, value)
+			}
+			return true
+		})
+	}
+
+	if !headers.Has("Date") {
+		headers.Set("Date", httpDate(time.Now()))
+	}
+
+	if w.status.IsInformational() || w.status == StatusNoContent || w.status == StatusNotModified {
+		headers.Del("Content-Length")
+		headers.Del("Transfer-Encoding")
+		w.discard = true
+		return w.writeHeaderSection(headers)
+	}
+
+	w.discard = w.head
+
+	if w.version == "1.0" && headers.Has("Transfer-Encoding") {
+		// The chunking overrides any Content-Length, as it would have
+		// for an HTTP/1.1 client.
+		headers.Del("Transfer-Encoding")
+		headers.Del("Content-Length")
+		headers.Del("Trailer")
+		w.close = true
+	}
+
+	if headers.HasToken("Transfer-Encoding", "chunked") && !w.discard {
+		w.chunked = true
+	}
+
+	if value, ok := headers.Get("Content-Length"); ok && !w.discard && !headers.Has("Transfer-Encoding") {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			w.contentLength = n
+			w.hasLength = true
+		}
+	}
+
+	if !headers.Has("Content-Length") && !headers.Has("Transfer-Encoding") {
+		w.pending = headers
+		w.bodyStart = w.Buffer.Len()
+		return nil
+	}
+
+	return w.writeHeaderSection(headers)
+}
+
+func (w *Writer) writeHeaderSection(headers *headers.Headers) error {
+	if w.closing != nil && w.closing() {
+		w.close = true
+	}
+
+	if headers.HasToken("Connection", "close") {
+		w.close = true
+	}
+
+	switch {
+	case w.close:
+		// Whatever Connection the handler set, the connection is
+		// closed after this response, so the client has to be told.
+		headers.Set("Connection", "close")
+	case w.version == "1.0" && !headers.Has("Connection"):
+		// HTTP/1.0 connections close by default, so staying open has to
+		// be announced.
+		headers.Set("Connection", "keep-alive")
+	}
+
+	if _, err := headers.WriteTo(w.Buffer); err != nil {
 		return err
-	case StatusInternalServerError:
-		_, err := w.Buffer.Write([]byte(fmt.Sprintf("%s %d %s\r\n", httpVersion, StatusInternalServerError, "Internal Server Error")))
+	}
+	_, err := w.Buffer.Write([]byte("\r\n"))
+
+	if err != nil {
 		return err
+	}
+
+	return nil
+}
+
+// writePendingHeaders writes the header section held back by WriteHeaders,
+// with the framing of the body buffered after it. A complete body gets a
+// Content-Length; otherwise the body is chunked if the connection stays open,
+// or ends with the connection. A HEAD response that is flushed early goes
+// without framing, since no body follows it anyway. When the handler switched
+// to WriteChunkedBody, the body buffered so far becomes the first chunk.
+func (w *Writer) writePendingHeaders(complete bool) error {
+	headers := w.pending
+	w.pending = nil
+
+	body := bytes.Clone(w.Buffer.Bytes()[w.bodyStart:])
+	w.Buffer.Truncate(w.bodyStart)
+
+	chunked := false
+	switch {
+	case headers.Has("Transfer-Encoding"):
+		// Set by WriteChunkedBody or WriteChunkedBodyDone.
+		chunked = true
+	case complete:
+		headers.Set("Content-Length", strconv.Itoa(w.bytesWritten))
+	case w.discard:
+	case w.version != "1.0" && !w.close && !headers.HasToken("Connection", "close"):
+		headers.Set("Transfer-Encoding", "chunked")
+		chunked = true
 	default:
-		_, err := w.Buffer.Write([]byte(fmt.Sprintf("%s %d\r\n", httpVersion, statusCode)))
+		w.close = true
+	}
+
+	if err := w.writeHeaderSection(headers); err != nil {
 		return err
 	}
+
+	w.chunked = chunked && !w.discard
+	if chunked {
+		return w.writeChunk(body)
+	}
+
+	_, err := w.Buffer.Write(body)
+	return err
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+// WriteBody appends p to the body. A handler that goes straight to the body
+// gets a 200 status line and default headers, framed as described in
+// WriteHeaders. Writing past the Content-Length the handler set is
+// refused with ErrBodyTooLong, since the extra bytes would be read as the
+// next response.
+func (w *Writer) WriteBody(p []byte) (int, error) {
+	if w.state == StateStatusLine || w.state == StateHeaders {
+		if err := w.writeDefaults(-1); err != nil {
+			return 0, err
+		}
+	}
 
-	for k, v := range headers {
-		_, err := w.Buffer.Write([]byte(fmt.Sprintf("%s: %s\r\n", k, v)))
-		if err != nil {
-			return err
+	if w.state != StateBody {
+		return 0, &WriterStateError{Op: "write body", State: w.state}
+	}
+
+	if w.discard {
+		w.bytesWritten += len(p)
+		return len(p), nil
+	}
+
+	if w.hasLength && w.bytesWritten+len(p) > w.contentLength {
+		return 0, fmt.Errorf("%w: %d bytes written over %d", ErrBodyTooLong, w.bytesWritten+len(p), w.contentLength)
+	}
+
+	if w.chunked {
+		if err := w.writeChunk(p); err != nil {
+			return 0, err
 		}
+		w.bytesWritten += len(p)
+		return len(p), nil
+	}
+
+	n, err := w.Buffer.Write(p)
+	w.bytesWritten += n
+	return n, err
+}
+
+func (w *Writer) writeChunk(p []byte) error {
+	if len(p) == 0 {
+		return nil
 	}
+
+	if _, err := fmt.Fprintf(w.Buffer, "%x\r\n", len(p)); err != nil {
+		return err
+	}
+
+	if _, err := w.Buffer.Write(p); err != nil {
+		return err
+	}
+
 	_, err := w.Buffer.Write([]byte("\r\n"))
+	return err
+}
+
+// WriteChunkedBody writes p as a single chunk of a "Transfer-Encoding: chunked"
+// body. Call Flush to send the chunks written so far. A body whose
+// Content-Length has already been written can't switch to chunks, so
+// ErrNotChunked is returned instead.
+func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.state != StateBody {
+		return 0, &WriterStateError{Op: "write chunked body", State: w.state}
+	}
+
+	if w.hasLength {
+		return 0, ErrNotChunked
+	}
+
+	if err := w.chunkPending(); err != nil {
+		return 0, err
+	}
+
+	switch {
+	case w.discard:
+	case w.chunked:
+		if err := w.writeChunk(p); err != nil {
+			return 0, err
+		}
+	default:
+		// The body ends with the connection, so chunks are sent as
+		// they are.
+		if _, err := w.Buffer.Write(p); err != nil {
+			return 0, err
+		}
+	}
+
+	w.bytesWritten += len(p)
+	return len(p), nil
+}
+
+// chunkPending writes a header section held back by WriteHeaders as the
+// start of a chunked body, or for HTTP/1.0 of one that ends with the
+// connection.
+func (w *Writer) chunkPending() error {
+	if w.pending == nil {
+		return nil
+	}
+
+	if w.version != "1.0" {
+		w.pending.Set("Transfer-Encoding", "chunked")
+	}
+	return w.writePendingHeaders(false)
+}
+
+// WriteChunkedBodyDone writes the last-chunk. Trailer fields may follow with
+// WriteTrailers, otherwise Finish ends the message.
+func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.state != StateBody {
+		return 0, &WriterStateError{Op: "end chunked body", State: w.state}
+	}
 
+	if w.hasLength {
+		return 0, ErrNotChunked
+	}
+
+	if err := w.chunkPending(); err != nil {
+		return 0, err
+	}
+
+	if w.discard || !w.chunked {
+		w.state = StateTrailers
+		return 0, nil
+	}
+
+	n, err := w.Buffer.Write([]byte("0\r\n"))
+	if err != nil {
+		return n, err
+	}
+
+	w.state = StateTrailers
+	return n, nil
+}
+
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
+	if w.state != StateTrailers {
+		return &WriterStateError{Op: "write trailers", State: w.state}
+	}
+
+	if w.discard || !w.chunked {
+		w.state = StateDone
+		return nil
+	}
+
+	if _, err := h.WriteTo(w.Buffer); err != nil {
+		return err
+	}
+
+	_, err := w.Buffer.Write([]byte("\r\n"))
 	if err != nil {
 		return err
 	}
 
+	w.state = StateDone
 	return nil
 }
 
-func (w *Writer) WriteBody(p []byte) (int, error) {
-	return w.Buffer.Write(p)
+// writeDefaults writes whatever is missing before the body: a 200 status line
+// and the default headers. A negative contentLen leaves out Content-Length.
+func (w *Writer) writeDefaults(contentLen int) error {
+	if w.state == StateStatusLine {
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			return err
+		}
+	}
+
+	headers := GetDefaultHeaders(contentLen)
+	if contentLen < 0 {
+		headers.Del("Content-Length")
+	}
+
+	return w.WriteHeaders(headers)
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	headers := headers.NewHeaders()
 	headers.Parse([]byte(fmt.Sprintf("Content-Length: %d\r\n", contentLen)))
-	headers.Parse([]byte("Connection: close\r\n"))
 	headers.Parse([]byte("Content-Type: text/plain\r\n"))
 
 	return headers
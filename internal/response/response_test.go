@@ -0,0 +1,345 @@
+package response
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterFraming(t *testing.T) {
+	// Test: a buffered body gets its Content-Length on Finish
+	conn := &bytes.Buffer{}
+	w := NewWriter(conn)
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err := w.WriteBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	out := conn.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "Content-Length: 11\r\n")
+	assert.Contains(t, out, "Date: ")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello world"))
+	assert.True(t, w.KeepAlive())
+
+	// Test: going straight to the body is framed the same way
+	conn = &bytes.Buffer{}
+	w = NewWriter(conn)
+	_, err = w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, conn.String(), "Content-Length: 2\r\n")
+	assert.True(t, w.KeepAlive())
+
+	// Test: flushing a body of unknown length switches to chunked
+	conn = &bytes.Buffer{}
+	w = NewWriter(conn)
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	w.WriteBody([]byte("hello"))
+	require.NoError(t, w.Flush())
+	w.WriteBody([]byte(" world"))
+	require.NoError(t, w.Finish())
+	out = conn.String()
+	assert.Contains(t, out, "Transfer-Encoding: chunked\r\n")
+	assert.NotContains(t, out, "Content-Length")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n"))
+	assert.True(t, w.KeepAlive())
+
+	// Test: HTTP/1.0 can't do chunked, so the connection delimits the body
+	conn = &bytes.Buffer{}
+	w = NewWriter(conn)
+	w.SetVersion("1.0")
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	w.WriteBody([]byte("hello"))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Finish())
+	out = conn.String()
+	assert.Contains(t, out, "Connection: close\r\n")
+	assert.NotContains(t, out, "Transfer-Encoding")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello"))
+	assert.False(t, w.KeepAlive())
+
+	// Test: an explicit Content-Length is left alone and written right away
+	w = NewWriter(nil)
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	assert.Contains(t, w.Buffer.String(), "Content-Length: 3\r\n")
+
+	// Test: a handler's Date header is kept
+	w = NewWriter(nil)
+	h := GetDefaultHeaders(0)
+	h.Set("Date", "Sun, 06 Nov 1994 08:49:37 GMT")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Equal(t, 1, strings.Count(w.Buffer.String(), "Date: "))
+	assert.Contains(t, w.Buffer.String(), "Date: Sun, 06 Nov 1994 08:49:37 GMT\r\n")
+}
+
+func TestWriterHeader(t *testing.T) {
+	// Test: every instance of a repeated field is added
+	w := NewWriter(nil)
+	w.Header().Add("Set-Cookie", "a=1")
+	w.Header().Add("Set-Cookie", "b=2")
+	w.Header().Set("X-Request-Id", "abc")
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	out := w.Buffer.String()
+	assert.Contains(t, out, "Set-Cookie: a=1\r\nSet-Cookie: b=2\r\n")
+	assert.Contains(t, out, "X-Request-Id: abc\r\n")
+
+	// Test: a field the handler sets replaces all instances from Header
+	w = NewWriter(nil)
+	w.Header().Add("Set-Cookie", "a=1")
+	w.Header().Add("Set-Cookie", "b=2")
+	h := GetDefaultHeaders(0)
+	h.Set("set-cookie", "c=3")
+	require.NoError(t, w.WriteHeaders(h))
+	out = w.Buffer.String()
+	assert.Equal(t, 1, strings.Count(strings.ToLower(out), "set-cookie"))
+	assert.Contains(t, out, "c=3")
+
+	// Test: a closing connection overrides the handler's Connection
+	w = NewWriter(nil)
+	w.SetKeepAlive(false)
+	h = GetDefaultHeaders(0)
+	h.Set("Connection", "keep-alive")
+	require.NoError(t, w.WriteHeaders(h))
+	out = w.Buffer.String()
+	assert.Contains(t, out, "Connection: close\r\n")
+	assert.NotContains(t, out, "keep-alive")
+
+	// Test: a handler's Connection: close is honored
+	w = NewWriter(nil)
+	h = GetDefaultHeaders(0)
+	h.Set("Connection", "close")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.False(t, w.KeepAlive())
+}
+
+func TestChunkedAfterHeaders(t *testing.T) {
+	// Test: ending a body of unknown length with the last-chunk makes it chunked
+	conn := &bytes.Buffer{}
+	w := NewWriter(conn)
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err := w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	out := conn.String()
+	assert.Contains(t, out, "Transfer-Encoding: chunked\r\n")
+	assert.NotContains(t, out, "Content-Length")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n0\r\n\r\n"), out)
+
+	// Test: a body buffered before WriteChunkedBody becomes the first chunk
+	conn = &bytes.Buffer{}
+	w = NewWriter(conn)
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	w.WriteBody([]byte("a"))
+	w.WriteChunkedBody([]byte("bc"))
+	w.WriteChunkedBodyDone()
+	require.NoError(t, w.Finish())
+	out = conn.String()
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n1\r\na\r\n2\r\nbc\r\n0\r\n\r\n"), out)
+
+	// Test: chunks can't follow a Content-Length
+	conn = &bytes.Buffer{}
+	w = NewWriter(conn)
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	_, err = w.WriteChunkedBody([]byte("abc"))
+	require.ErrorIs(t, err, ErrNotChunked)
+	_, err = w.WriteChunkedBodyDone()
+	require.ErrorIs(t, err, ErrNotChunked)
+	_, err = w.WriteBody([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(conn.String(), "\r\n\r\nabc"))
+
+	// Test: WriteBody is framed when the handler's headers say chunked
+	conn = &bytes.Buffer{}
+	w = NewWriter(conn)
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteBody([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	out = conn.String()
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n3\r\nabc\r\n0\r\n\r\n"), out)
+}
+
+func TestWriterOrder(t *testing.T) {
+	var stateErr *WriterStateError
+
+	// Test: a second status line is refused
+	w := NewWriter(nil)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	err := w.WriteStatusLine(StatusNotFound)
+	require.ErrorAs(t, err, &stateErr)
+	assert.Equal(t, StateHeaders, stateErr.State)
+	assert.Equal(t, "response: cannot write status line while writing headers", err.Error())
+
+	// Test: headers can't follow the body
+	w = NewWriter(nil)
+	_, err = w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	err = w.WriteHeaders(GetDefaultHeaders(2))
+	require.ErrorAs(t, err, &stateErr)
+	assert.Equal(t, StateBody, stateErr.State)
+
+	// Test: a status line can't follow the headers
+	w = NewWriter(nil)
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	require.ErrorAs(t, w.WriteStatusLine(StatusOK), &stateErr)
+
+	// Test: trailers can't come before the last-chunk
+	w = NewWriter(nil)
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	err = w.WriteTrailers(headers.NewHeaders())
+	require.ErrorAs(t, err, &stateErr)
+	assert.Equal(t, StateBody, stateErr.State)
+
+	// Test: nothing can be written once the trailers are
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+	_, err = w.WriteChunkedBody([]byte("late"))
+	require.ErrorAs(t, err, &stateErr)
+	assert.Equal(t, StateDone, stateErr.State)
+	_, err = w.WriteBody([]byte("late"))
+	require.ErrorAs(t, err, &stateErr)
+
+	// Test: interim responses can't follow the final status line
+	w = NewWriter(nil)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.ErrorAs(t, w.WriteInformational(StatusContinue, nil), &stateErr)
+}
+
+func TestChunkedBody(t *testing.T) {
+	// Test: each write is one chunk, ended by the last-chunk and trailers
+	conn := &bytes.Buffer{}
+	w := NewWriter(conn)
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("chunked world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	out := conn.String()
+	_, body, ok := strings.Cut(out, "\r\n\r\n")
+	require.True(t, ok)
+	assert.Equal(t, "6\r\nhello \r\n"+
+		"d\r\nchunked world\r\n"+
+		"0\r\n"+
+		"X-Checksum: abc\r\n"+
+		"\r\n", body)
+	assert.Equal(t, 19, w.BytesWritten())
+
+	// Test: without trailers, Finish ends the message after the last-chunk
+	conn = &bytes.Buffer{}
+	w = NewWriter(conn)
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	w.WriteChunkedBody([]byte("hi"))
+	w.WriteChunkedBodyDone()
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(conn.String(), "\r\n\r\n2\r\nhi\r\n0\r\n\r\n"))
+
+	// Test: HTTP/1.0 gets the chunks as they are, without trailers, and the
+	// connection ends the body
+	conn = &bytes.Buffer{}
+	w = NewWriter(conn)
+	w.SetVersion("1.0")
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteHeaders(h))
+	w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, w.Flush())
+	w.WriteChunkedBody([]byte("world"))
+	w.WriteChunkedBodyDone()
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	out = conn.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.0 200 OK\r\n"))
+	assert.NotContains(t, out, "Transfer-Encoding")
+	assert.NotContains(t, out, "Trailer")
+	assert.NotContains(t, out, "X-Checksum")
+	assert.Contains(t, out, "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello world"), out)
+	assert.False(t, w.KeepAlive())
+}
+
+func TestWriterIncomplete(t *testing.T) {
+	// Test: an aborted response sends nothing still buffered
+	conn := &bytes.Buffer{}
+	w := NewWriter(conn)
+	w.WriteBody([]byte("partial"))
+	w.Abort()
+	require.ErrorIs(t, w.Finish(), ErrAborted)
+	assert.Empty(t, conn.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: an aborted chunked response is never terminated
+	conn = &bytes.Buffer{}
+	w = NewWriter(conn)
+	w.WriteBody([]byte("hello"))
+	require.NoError(t, w.Flush())
+	w.WriteBody([]byte(" world"))
+	w.Abort()
+	require.ErrorIs(t, w.Finish(), ErrAborted)
+	out := conn.String()
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n5\r\nhello\r\n"), out)
+
+	// Test: writing past the Content-Length is refused
+	conn = &bytes.Buffer{}
+	w = NewWriter(conn)
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	_, err := w.WriteBody([]byte("ab"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("cd"))
+	require.ErrorIs(t, err, ErrBodyTooLong)
+	_, err = w.WriteBody([]byte("c"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(conn.String(), "\r\n\r\nabc"))
+
+	// Test: a body shorter than its Content-Length is aborted
+	conn = &bytes.Buffer{}
+	w = NewWriter(conn)
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	w.WriteBody([]byte("ab"))
+	require.ErrorIs(t, w.Finish(), ErrBodyTooShort)
+	assert.Empty(t, conn.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: HEAD responses keep their Content-Length without a body
+	conn = &bytes.Buffer{}
+	w = NewWriter(conn)
+	w.SetRequestMethod("HEAD")
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, conn.String(), "Content-Length: 3\r\n")
+}
+
+func TestHTTPDate(t *testing.T) {
+	// Test: dates are formatted in GMT
+	now := time.Date(1994, time.November, 6, 9, 49, 37, 0, time.FixedZone("CET", 3600))
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", httpDate(now))
+
+	// Test: the value is reused within the same second
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", httpDate(now.Add(500*time.Millisecond)))
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:38 GMT", httpDate(now.Add(time.Second)))
+}
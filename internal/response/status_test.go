@@ -0,0 +1,46 @@
+package response
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusCodes(t *testing.T) {
+	// Test: registered codes have their reason phrase
+	assert.Equal(t, "Not Found", StatusText(StatusNotFound))
+	assert.Equal(t, "Early Hints", StatusText(StatusEarlyHints))
+	assert.Equal(t, "Unprocessable Content", StatusText(StatusUnprocessableContent))
+	assert.Equal(t, "", StatusText(299))
+
+	// Test: classes
+	assert.True(t, StatusContinue.IsInformational())
+	assert.True(t, StatusNoContent.IsSuccess())
+	assert.True(t, StatusPermanentRedirect.IsRedirect())
+	assert.False(t, StatusOK.IsRedirect())
+	assert.True(t, StatusTooManyRequests.IsClientError())
+	assert.True(t, StatusBadGateway.IsServerError())
+	assert.True(t, StatusNotFound.IsError())
+	assert.True(t, StatusInternalServerError.IsError())
+	assert.False(t, StatusFound.IsError())
+	assert.False(t, StatusCode(99).IsValid())
+	assert.False(t, StatusCode(600).IsValid())
+
+	// Test: an unregistered code keeps the space before the empty reason
+	w := NewWriter(nil)
+	require.NoError(t, w.WriteStatusLine(299))
+	assert.Equal(t, "HTTP/1.1 299 \r\n", w.Buffer.String())
+
+	// Test: codes outside 100-599 are refused and nothing is written
+	w = NewWriter(nil)
+	require.ErrorIs(t, w.WriteStatusLine(600), ErrInvalidStatusCode)
+	require.ErrorIs(t, w.WriteStatusLine(42), ErrInvalidStatusCode)
+	assert.False(t, w.Written())
+	assert.Equal(t, 0, w.Buffer.Len())
+
+	// Test: informational responses only take 1xx codes
+	require.ErrorIs(t, w.WriteInformational(StatusOK, nil), ErrInvalidStatusCode)
+	require.NoError(t, w.WriteInformational(StatusEarlyHints, nil))
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\n\r\n", w.Buffer.String())
+}
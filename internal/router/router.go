@@ -0,0 +1,217 @@
+package router
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"sort"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	literalSegment segmentKind = iota
+	paramSegment
+	wildcardSegment
+)
+
+type segment struct {
+	kind  segmentKind
+	value string
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []segment
+	handler  server.Handler
+}
+
+// Router dispatches requests to handlers registered by method and path
+// pattern. Patterns are made of "/"-separated segments that are either
+// literals, "{name}" captures matching a single segment, or a trailing
+// "{name...}" (or "*") capturing the rest of the path. Patterns are matched
+// against the canonical Request.Path and captured values are available
+// through Request.PathValue.
+//
+// When several patterns match, the most specific one wins: literals beat
+// captures and captures beat wildcards, segment by segment.
+//
+// HEAD requests without a HEAD route of their own are served by the GET
+// route; the response writer drops the body and keeps its Content-Length.
+type Router struct {
+	routes []route
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+func (rt *Router) Handle(method string, pattern string, handler server.Handler) {
+	rt.routes = append(rt.routes, route{
+		method:   method,
+		pattern:  pattern,
+		segments: parsePattern(pattern),
+		handler:  handler,
+	})
+}
+
+func (rt *Router) Get(pattern string, handler server.Handler) {
+	rt.Handle("GET", pattern, handler)
+}
+
+func (rt *Router) Post(pattern string, handler server.Handler) {
+	rt.Handle("POST", pattern, handler)
+}
+
+func (rt *Router) Put(pattern string, handler server.Handler) {
+	rt.Handle("PUT", pattern, handler)
+}
+
+func (rt *Router) Delete(pattern string, handler server.Handler) {
+	rt.Handle("DELETE", pattern, handler)
+}
+
+// ServeRequest has the signature of a server.Handler, so the router can be
+// passed directly to server.Serve as rt.ServeRequest.
+func (rt *Router) ServeRequest(w *response.Writer, req *request.Request) *server.HandlerError {
+	pathSegments := strings.Split(strings.TrimPrefix(req.Path, "/"), "/")
+
+	var best *route
+	var bestValues map[string]string
+	var fallback *route
+	var fallbackValues map[string]string
+	allowed := []string{}
+
+	for i := range rt.routes {
+		r := &rt.routes[i]
+
+		values, ok := match(r.segments, pathSegments)
+		if !ok {
+			continue
+		}
+
+		allowed = appendUnique(allowed, r.method)
+		if r.method == "GET" {
+			allowed = appendUnique(allowed, "HEAD")
+		}
+
+		switch {
+		case r.method == req.RequestLine.Method:
+			if best == nil || moreSpecific(r.segments, best.segments) {
+				best = r
+				bestValues = values
+			}
+		case r.method == "GET" && req.RequestLine.Method == "HEAD":
+			if fallback == nil || moreSpecific(r.segments, fallback.segments) {
+				fallback = r
+				fallbackValues = values
+			}
+		}
+	}
+
+	if best == nil {
+		best, bestValues = fallback, fallbackValues
+	}
+
+	if best != nil {
+		for name, value := range bestValues {
+			req.SetPathValue(name, value)
+		}
+
+		return best.handler(w, req)
+	}
+
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		body := []byte("Method Not Allowed\n")
+
+		w.WriteStatusLine(response.StatusMethodNotAllowed)
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("Allow", strings.Join(allowed, ", "))
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+		return nil
+	}
+
+	return &server.HandlerError{
+		Message:     "Not Found\n",
+		ContentType: "text/plain",
+		StatusCode:  response.StatusNotFound,
+	}
+}
+
+func parsePattern(pattern string) []segment {
+	parts := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	segments := make([]segment, 0, len(parts))
+
+	for _, part := range parts {
+		switch {
+		case part == "*":
+			segments = append(segments, segment{kind: wildcardSegment, value: "*"})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "...}"):
+			segments = append(segments, segment{kind: wildcardSegment, value: part[1 : len(part)-4]})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			segments = append(segments, segment{kind: paramSegment, value: part[1 : len(part)-1]})
+		default:
+			segments = append(segments, segment{kind: literalSegment, value: part})
+		}
+	}
+
+	return segments
+}
+
+func match(segments []segment, pathSegments []string) (map[string]string, bool) {
+	values := map[string]string{}
+
+	for i, seg := range segments {
+		if seg.kind == wildcardSegment {
+			values[seg.value] = strings.Join(pathSegments[min(i, len(pathSegments)):], "/")
+			return values, true
+		}
+
+		if i >= len(pathSegments) {
+			return nil, false
+		}
+
+		switch seg.kind {
+		case literalSegment:
+			if seg.value != pathSegments[i] {
+				return nil, false
+			}
+		case paramSegment:
+			if pathSegments[i] == "" {
+				return nil, false
+			}
+			values[seg.value] = pathSegments[i]
+		}
+	}
+
+	if len(segments) != len(pathSegments) {
+		return nil, false
+	}
+
+	return values, true
+}
+
+// moreSpecific reports whether a should be preferred over b when both match.
+func moreSpecific(a []segment, b []segment) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].kind != b[i].kind {
+			return a[i].kind < b[i].kind
+		}
+	}
+
+	return len(a) > len(b)
+}
+
+func appendUnique(methods []string, method string) []string {
+	for _, m := range methods {
+		if m == method {
+			return methods
+		}
+	}
+
+	return append(methods, method)
+}
@@ -0,0 +1,104 @@
+package router
+
+import (
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(method string, target string) *request.Request {
+	path, query, _ := strings.Cut(target, "?")
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			HttpVersion:   "1.1",
+			RequestTarget: target,
+			Method:        method,
+			RawPath:       path,
+			RawQuery:      query,
+		},
+		Path:    path,
+		Headers: headers.NewHeaders(),
+	}
+}
+
+func named(name string, matched *string) server.Handler {
+	return func(w *response.Writer, req *request.Request) *server.HandlerError {
+		*matched = name
+		return nil
+	}
+}
+
+func TestRouter(t *testing.T) {
+	matched := ""
+	rt := New()
+	rt.Get("/", named("root", &matched))
+	rt.Get("/users/{id}", named("user", &matched))
+	rt.Get("/users/me", named("me", &matched))
+	rt.Post("/users/{id}", named("update", &matched))
+	rt.Get("/static/{path...}", named("static", &matched))
+	rt.Get("/files/*", named("files", &matched))
+
+	// Test: Root path
+	hErr := rt.ServeRequest(response.NewWriter(nil), newRequest("GET", "/"))
+	require.Nil(t, hErr)
+	assert.Equal(t, "root", matched)
+
+	// Test: Captured parameter
+	req := newRequest("GET", "/users/42?verbose=1")
+	hErr = rt.ServeRequest(response.NewWriter(nil), req)
+	require.Nil(t, hErr)
+	assert.Equal(t, "user", matched)
+	assert.Equal(t, "42", req.PathValue("id"))
+
+	// Test: Literal segment beats a capture
+	hErr = rt.ServeRequest(response.NewWriter(nil), newRequest("GET", "/users/me"))
+	require.Nil(t, hErr)
+	assert.Equal(t, "me", matched)
+
+	// Test: Same pattern, different method
+	hErr = rt.ServeRequest(response.NewWriter(nil), newRequest("POST", "/users/7"))
+	require.Nil(t, hErr)
+	assert.Equal(t, "update", matched)
+
+	// Test: Trailing wildcards
+	req = newRequest("GET", "/static/css/site.css")
+	hErr = rt.ServeRequest(response.NewWriter(nil), req)
+	require.Nil(t, hErr)
+	assert.Equal(t, "static", matched)
+	assert.Equal(t, "css/site.css", req.PathValue("path"))
+
+	req = newRequest("GET", "/files/a/b")
+	hErr = rt.ServeRequest(response.NewWriter(nil), req)
+	require.Nil(t, hErr)
+	assert.Equal(t, "files", matched)
+	assert.Equal(t, "a/b", req.PathValue("*"))
+
+	// Test: Unknown path is a 404
+	hErr = rt.ServeRequest(response.NewWriter(nil), newRequest("GET", "/nope"))
+	require.NotNil(t, hErr)
+	assert.Equal(t, response.StatusNotFound, hErr.StatusCode)
+
+	// Test: Known path with the wrong method is a 405 with Allow
+	w := response.NewWriter(nil)
+	hErr = rt.ServeRequest(w, newRequest("DELETE", "/users/7"))
+	require.Nil(t, hErr)
+	assert.Equal(t, response.StatusMethodNotAllowed, w.Status())
+	assert.Contains(t, w.Buffer.String(), "Allow: GET, HEAD, POST\r\n")
+
+	// Test: HEAD falls back to the GET route
+	hErr = rt.ServeRequest(response.NewWriter(nil), newRequest("HEAD", "/users/me"))
+	require.Nil(t, hErr)
+	assert.Equal(t, "me", matched)
+
+	// Test: a HEAD route of its own wins over the GET one
+	rt.Handle("HEAD", "/users/{id}", named("head", &matched))
+	hErr = rt.ServeRequest(response.NewWriter(nil), newRequest("HEAD", "/users/7"))
+	require.Nil(t, hErr)
+	assert.Equal(t, "head", matched)
+}
@@ -1,22 +1,43 @@
 package server
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"io"
 	"log"
 	"net"
+	"os"
 	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// Causes of a request context being cancelled, see context.Cause.
+var (
+	ErrServerClosed       = errors.New("server closed")
+	ErrClientDisconnected = errors.New("client disconnected")
+	ErrHandlerTimeout     = errors.New("handler timeout")
+)
+
+// maxDiscardBytes is how much of a body left unread by the handler is read
+// and dropped to keep the connection open for the next request.
+const maxDiscardBytes = 256 << 10
+
+// defaultIdleTimeout is how long a kept-alive connection may sit without a
+// new request before the server closes it, unless Config.IdleTimeout is set.
+const defaultIdleTimeout = 30 * time.Second
+
 type HandlerError struct {
 	Message     string
 	ContentType string
 	StatusCode  response.StatusCode
 }
 
-func (hErr *HandlerError) Write(w response.Writer) error {
+func (hErr *HandlerError) Write(w *response.Writer) error {
 	err := w.WriteStatusLine(hErr.StatusCode)
 
 	if err != nil {
@@ -26,7 +47,9 @@ func (hErr *HandlerError) Write(w response.Writer) error {
 	body := []byte(hErr.Message)
 
 	headers := response.GetDefaultHeaders(len(body))
-	headers.Override("Content-Type", hErr.ContentType)
+	if hErr.ContentType != "" {
+		headers.Set("Content-Type", hErr.ContentType)
+	}
 	if err := w.WriteHeaders(headers); err != nil {
 		return err
 	}
@@ -37,14 +60,145 @@ func (hErr *HandlerError) Write(w response.Writer) error {
 
 type Handler func(w *response.Writer, req *request.Request) *HandlerError
 
+// Middleware wraps a Handler with behavior that runs around it.
+type Middleware func(Handler) Handler
+
+// Chain wraps handler with middleware, the first one being the outermost:
+// Chain(h, a, b) runs a, then b, then h.
+func Chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler
+}
+
+type connState int
+
+const (
+	// connIdle is a connection waiting for its next request.
+	connIdle connState = iota
+	// connActive is a connection that has started receiving a request and
+	// hasn't finished responding to it.
+	connActive
+)
+
+// Config holds the optional settings of a Server. A zero duration disables
+// the corresponding timeout.
+type Config struct {
+	// ReadHeaderTimeout bounds reading the request line and headers, from the
+	// first byte of the request. A client that is too slow gets a 408. If
+	// zero, ReadTimeout is used.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds reading the whole request, body included, from the
+	// first byte of the request. Since handlers stream the body, it also
+	// bounds how long they may take to read it.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds handling the request and writing the response, from
+	// when the handler is called. The request context expires with it.
+	WriteTimeout time.Duration
+	// IdleTimeout bounds waiting for the next request on a kept-alive
+	// connection. If zero, defaultIdleTimeout is used.
+	IdleTimeout time.Duration
+	// Limits caps the size of incoming requests.
+	Limits request.Limits
+	// RejectEncodedSlashes answers 400 to requests whose path contains "%2F".
+	RejectEncodedSlashes bool
+	// UnfoldObsFold accepts obsolete line folding in request headers instead
+	// of answering 400.
+	UnfoldObsFold bool
+	// Strict hardens request parsing against smuggling, see
+	// request.Reader.Strict.
+	Strict bool
+	// ServerHeader is sent as the Server header of every response, unless
+	// empty or set by the handler.
+	ServerHeader string
+	// BufferBody reads the whole request body into Request.Body before
+	// calling the handler, instead of letting the handler stream it from
+	// Request.BodyReader.
+	BufferBody bool
+	// ExpectContinue decides whether a request sent with "Expect:
+	// 100-continue" may upload its body, before the handler runs. Returning
+	// nil passes the request on to the handler, and "100 Continue" is sent
+	// once it reads the body; returning an error answers the request with
+	// it instead, typically a 417 or a 413, and closes the connection. If
+	// nil, every such request is passed on.
+	ExpectContinue func(req *request.Request) *HandlerError
+	// ErrorFormatter builds the response sent for requests that can't be
+	// read. If nil, DefaultErrorFormatter is used.
+	ErrorFormatter ErrorFormatter
+}
+
+// ErrorFormatter builds the response sent when a request fails to parse or
+// times out, given the status code the server picked for err.
+type ErrorFormatter func(statusCode response.StatusCode, err error) *HandlerError
+
+// DefaultErrorFormatter answers with a plain text body made of the status
+// code, its reason phrase and the error, e.g.
+// "400 Bad Request: malformed request line".
+func DefaultErrorFormatter(statusCode response.StatusCode, err error) *HandlerError {
+	return &HandlerError{
+		Message:     fmt.Sprintf("%d %s: %v\n", statusCode, response.StatusText(statusCode), err),
+		ContentType: "text/plain",
+		StatusCode:  statusCode,
+	}
+}
+
+func (c Config) errorFormatter() ErrorFormatter {
+	if c.ErrorFormatter != nil {
+		return c.ErrorFormatter
+	}
+
+	return DefaultErrorFormatter
+}
+
+func (c Config) readHeaderTimeout() time.Duration {
+	if c.ReadHeaderTimeout != 0 {
+		return c.ReadHeaderTimeout
+	}
+
+	return c.ReadTimeout
+}
+
+func (c Config) idleTimeout() time.Duration {
+	if c.IdleTimeout != 0 {
+		return c.IdleTimeout
+	}
+
+	return defaultIdleTimeout
+}
+
+// deadline returns the time timeout after start, or the zero time, which
+// clears a connection deadline, if timeout is zero.
+func deadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+
+	return start.Add(timeout)
+}
+
 type Server struct {
 	Port     string
 	handler  Handler
 	listener net.Listener
 	closed   atomic.Bool
+	config   Config
+
+	// baseCtx is the parent of every request context, cancelled by Close
+	// and Shutdown.
+	baseCtx    context.Context
+	cancelBase context.CancelCauseFunc
+
+	mu    sync.Mutex
+	conns map[net.Conn]connState
 }
 
 func Serve(port int, handler Handler) (*Server, error) {
+	return ServeConfig(port, handler, Config{})
+}
+
+func ServeConfig(port int, handler Handler, config Config) (*Server, error) {
 
 	portStr := ":" + strconv.Itoa(port)
 	l, err := net.Listen("tcp", portStr)
@@ -52,20 +206,182 @@ func Serve(port int, handler Handler) (*Server, error) {
 		log.Fatal(err.Error())
 	}
 
-	server := &Server{
-		Port:     portStr,
-		listener: l,
-		handler:  handler,
-	}
+	server := newServer(handler, config)
+	server.Port = portStr
+	server.listener = l
 
 	go server.listen()
 	return server, nil
 
 }
 
+func newServer(handler Handler, config Config) *Server {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	return &Server{
+		handler:    handler,
+		config:     config,
+		conns:      map[net.Conn]connState{},
+		baseCtx:    ctx,
+		cancelBase: cancel,
+	}
+}
+
+// Close stops accepting connections and closes all open ones immediately,
+// including those in the middle of a request.
 func (s *Server) Close() error {
 	s.closed.Store(true)
-	return s.listener.Close()
+	s.cancelBase(ErrServerClosed)
+	err := s.listener.Close()
+	s.closeConns(false)
+	return err
+}
+
+// shutdownPollInterval is how often Shutdown checks whether the in-flight
+// requests are done.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown stops accepting connections, closes idle ones and waits for the
+// in-flight requests to be answered before closing their connections. The
+// contexts of those requests are cancelled with ErrServerClosed, so handlers
+// doing long work can wrap it up. If ctx expires first, the remaining
+// connections are closed forcefully and the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closed.Store(true)
+	s.cancelBase(ErrServerClosed)
+	err := s.listener.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.closeConns(true) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			s.closeConns(false)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeConns closes the tracked connections, only the idle ones if idleOnly
+// is set, and reports whether none are left open.
+func (s *Server) closeConns(idleOnly bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn, state := range s.conns {
+		if idleOnly && state != connIdle {
+			continue
+		}
+
+		conn.Close()
+		delete(s.conns, conn)
+	}
+
+	return len(s.conns) == 0
+}
+
+func (s *Server) setConnState(conn net.Conn, state connState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conns[conn] = state
+}
+
+func (s *Server) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// activityReader marks its connection active as soon as bytes of a new
+// request arrive, so Shutdown doesn't mistake a request that is still being
+// received for an idle connection. It also records when the request started
+// and switches the read deadline from the idle timeout to the header timeout.
+//
+// While a handler runs, it can also watch the connection for the client going
+// away, see startBackgroundRead.
+type activityReader struct {
+	server  *Server
+	conn    net.Conn
+	waiting bool
+	started time.Time
+
+	// peeked holds what the background read got, which is the start of the
+	// next request.
+	peeked     []byte
+	background chan struct{}
+	stopping   atomic.Bool
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	var n int
+	var err error
+
+	if len(r.peeked) > 0 {
+		n = copy(p, r.peeked)
+		r.peeked = r.peeked[n:]
+	} else {
+		n, err = r.conn.Read(p)
+	}
+
+	if n > 0 && r.waiting {
+		r.waiting = false
+		r.started = time.Now()
+		r.server.setConnState(r.conn, connActive)
+		r.conn.SetReadDeadline(deadline(r.started, r.server.config.readHeaderTimeout()))
+	}
+
+	return n, err
+}
+
+// wait prepares the reader for the next request on the connection.
+func (r *activityReader) wait() {
+	r.waiting = true
+	r.started = time.Now()
+}
+
+// startBackgroundRead reads from the connection in the background and calls
+// cancel with ErrClientDisconnected if it gets closed. It must only be used
+// once the request has been read entirely: any byte that arrives belongs to
+// the next request and is kept for it.
+func (r *activityReader) startBackgroundRead(cancel context.CancelCauseFunc) {
+	r.stopping.Store(false)
+	r.background = make(chan struct{})
+
+	go func() {
+		defer close(r.background)
+
+		buf := make([]byte, 1)
+		n, err := r.conn.Read(buf)
+		if n > 0 {
+			r.peeked = buf[:n]
+			return
+		}
+
+		if err != nil && !r.stopping.Load() {
+			cancel(ErrClientDisconnected)
+		}
+	}()
+}
+
+// stopBackgroundRead interrupts the background read, if any, and waits for it
+// to return.
+func (r *activityReader) stopBackgroundRead() {
+	if r.background == nil {
+		return
+	}
+
+	r.stopping.Store(true)
+	r.conn.SetReadDeadline(time.Unix(1, 0))
+	<-r.background
+	r.background = nil
 }
 
 func (s *Server) listen() {
@@ -89,30 +405,259 @@ func (s *Server) listen() {
 
 func (s *Server) handle(conn net.Conn) {
 	defer conn.Close()
-	req, err := request.RequestFromReader(conn)
+	defer s.forgetConn(conn)
+	activity := &activityReader{server: s, conn: conn}
+	reader := request.NewReader(activity)
+	reader.Limits = s.config.Limits
+	reader.RejectEncodedSlashes = s.config.RejectEncodedSlashes
+	reader.UnfoldObsFold = s.config.UnfoldObsFold
+	reader.Strict = s.config.Strict
 
-	buf := bytes.NewBuffer([]byte{})
-	writer := &response.Writer{
-		Buffer: buf,
+	for {
+		s.setConnState(conn, connIdle)
+		if s.closed.Load() {
+			return
+		}
+
+		if !s.serveRequest(conn, activity, reader) {
+			return
+		}
+	}
+}
+
+// serveRequest reads and answers the next request on conn, and reports
+// whether the connection can be used for another one.
+func (s *Server) serveRequest(conn net.Conn, activity *activityReader, reader *request.Reader) bool {
+	activity.wait()
+	conn.SetReadDeadline(deadline(time.Now(), s.config.idleTimeout()))
+	req, err := reader.ReadRequestHeader()
+
+	writer := response.NewWriter(conn)
+	if s.config.ServerHeader != "" {
+		writer.Header().Set("Server", s.config.ServerHeader)
 	}
 
 	if err != nil {
-		hErr := &HandlerError{
-			StatusCode: response.StatusBadRequest,
-			Message:    err.Error(),
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return false
 		}
-		hErr.Write(*writer)
-		conn.Write(writer.Buffer.Bytes())
-		return
+
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if activity.waiting {
+				return false
+			}
+
+			conn.SetWriteDeadline(deadline(time.Now(), s.config.WriteTimeout))
+			s.reject(writer, response.StatusRequestTimeout, errors.New("request header timeout"))
+			return false
+		}
+
+		s.reject(writer, statusForError(err), err)
+		return false
+	}
+
+	s.setConnState(conn, connActive)
+	conn.SetReadDeadline(deadline(activity.started, s.config.ReadTimeout))
+	writer.SetVersion(req.RequestLine.HttpVersion)
+	writer.SetRequestMethod(req.RequestLine.Method)
+
+	// Refused before anything else, so neither a 100 Continue nor reading
+	// the body is spent on it.
+	if _, ok := req.Headers.Get("Host"); !ok && req.RequestLine.HttpVersion == "1.1" {
+		conn.SetWriteDeadline(deadline(time.Now(), s.config.WriteTimeout))
+		s.reject(writer, response.StatusBadRequest, request.ErrMissingHost)
+		return false
+	}
+
+	if !s.checkExpect(writer, req) {
+		return false
+	}
+
+	// A client expecting 100 Continue waits for it before sending the body.
+	var expect *continueReader
+	if req.ExpectContinue() && req.Status != request.Done {
+		expect = &continueReader{ReadCloser: req.BodyReader, writer: writer}
+		req.BodyReader = expect
 	}
 
-	hErr := s.handler(writer, req)
+	if s.config.BufferBody {
+		if expect != nil {
+			conn.SetWriteDeadline(deadline(time.Now(), s.config.WriteTimeout))
+			if err := expect.sendContinue(); err != nil {
+				return false
+			}
+		}
+
+		if err := reader.ReadBody(req); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
+				return false
+			}
+
+			s.reject(writer, statusForError(err), err)
+			return false
+		}
+	}
+
+	conn.SetWriteDeadline(deadline(time.Now(), s.config.WriteTimeout))
+	writer.SetKeepAlive(req.KeepAlive())
+	// A shutdown may start while the handler runs, and the body it leaves
+	// unread may be too large to skip, or never be sent by a client that
+	// didn't get its 100 Continue, in which case the connection is closed
+	// once it returns.
+	writer.SetClosing(func() bool {
+		if expect != nil && !expect.sent && req.UnreadBodyLength() != 0 {
+			return true
+		}
+
+		return s.closed.Load() || req.UnreadBodyLength() > maxDiscardBytes
+	})
+
+	ctx, cancel := s.requestContext()
+	defer cancel(nil)
+
+	if req.Status == request.Done {
+		// With the body read, the client has nothing left to send until
+		// the response, so a read that ends means it went away.
+		conn.SetReadDeadline(time.Time{})
+		activity.startBackgroundRead(cancel)
+	}
+
+	// The handler gets its own copy carrying the context, the body is read
+	// through the original which the reader keeps track of.
+	hErr := s.handler(writer, req.WithContext(ctx))
+	activity.stopBackgroundRead()
 
 	if hErr != nil {
-		hErr.Write(*writer)
-		conn.Write(writer.Buffer.Bytes())
-		return
+		if writer.Written() {
+			// The response is already underway, so the error can't be
+			// reported to the client, and ending the response would
+			// pass its partial body off as complete.
+			log.Printf("Handler error after response was started: %s\n", hErr.Message)
+			writer.Abort()
+			return false
+		} else if err := hErr.Write(writer); err != nil {
+			log.Printf("Handler error could not be written: %v\n", err)
+			s.reject(writer, response.StatusInternalServerError, err)
+			return false
+		}
 	}
 
-	conn.Write(writer.Buffer.Bytes())
+	if err := writer.Finish(); err != nil || !writer.KeepAlive() {
+		return false
+	}
+
+	// Whatever the handler left of the body has to be read before the
+	// next request. That only happens once the response is out, so a
+	// client still sending a body the handler refused isn't kept waiting
+	// for the answer. A body too large to be worth reading, or that turns
+	// out to be broken, closes the connection instead.
+	return reader.DiscardBody(req, maxDiscardBytes) == nil
+}
+
+// requestContext returns the context for the next request, cancelled when the
+// server shuts down or, with a WriteTimeout, when the handler runs out of
+// time.
+func (s *Server) requestContext() (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(s.baseCtx)
+	if s.config.WriteTimeout == 0 {
+		return ctx, cancel
+	}
+
+	ctx, cancelTimeout := context.WithTimeoutCause(ctx, s.config.WriteTimeout, ErrHandlerTimeout)
+	return ctx, func(cause error) {
+		// Cancel the parent first, so its cause is the one reported.
+		cancel(cause)
+		cancelTimeout()
+	}
+}
+
+// checkExpect handles the Expect header of req before its body is read, and
+// reports whether the request can go on. If it can't, the response has been
+// sent.
+func (s *Server) checkExpect(writer *response.Writer, req *request.Request) bool {
+	expect, ok := req.Headers.Get("Expect")
+	if !ok || req.RequestLine.HttpVersion == "1.0" {
+		return true
+	}
+
+	if !req.ExpectContinue() {
+		s.reject(writer, response.StatusExpectationFailed, fmt.Errorf("%w: %s", request.ErrUnsupportedExpect, expect))
+		return false
+	}
+
+	if s.config.ExpectContinue != nil {
+		if hErr := s.config.ExpectContinue(req); hErr != nil {
+			// The client may send the body anyway, and it would be read
+			// as the next request, so the connection can't be reused.
+			writer.SetKeepAlive(false)
+			hErr.Write(writer)
+			writer.Finish()
+			return false
+		}
+	}
+
+	return true
+}
+
+// continueReader sends the 100 Continue a client is waiting for on the first
+// read of the body, so a handler that answers without reading it doesn't
+// make the client upload it for nothing. Once the final response has been
+// started, it is too late for an interim one and none is sent.
+type continueReader struct {
+	io.ReadCloser
+	writer *response.Writer
+	sent   bool
+	done   bool
+}
+
+func (c *continueReader) Read(p []byte) (int, error) {
+	if !c.done {
+		c.done = true
+		if !c.writer.Written() {
+			if err := c.sendContinue(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return c.ReadCloser.Read(p)
+}
+
+func (c *continueReader) sendContinue() error {
+	if err := c.writer.WriteInformational(response.StatusContinue, nil); err != nil {
+		return err
+	}
+
+	c.sent = true
+	return nil
+}
+
+// reject answers a request that can't be handled and marks the connection to
+// be closed, since the rest of the stream can't be trusted.
+func (s *Server) reject(writer *response.Writer, statusCode response.StatusCode, err error) {
+	hErr := s.config.errorFormatter()(statusCode, err)
+
+	writer.SetKeepAlive(false)
+	hErr.Write(writer)
+	writer.Finish()
+}
+
+// statusForError picks the status code for a request that failed to parse.
+func statusForError(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		return response.StatusURITooLong
+	case errors.Is(err, request.ErrHeaderTooLarge), errors.Is(err, request.ErrTooManyHeaders):
+		return response.StatusHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return response.StatusContentTooLarge
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return response.StatusNotImplemented
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return response.StatusHTTPVersionNotSupported
+	default:
+		// Malformed request lines, targets, header fields, content-lengths
+		// and chunks are all the client's fault, as are ambiguous lengths.
+		return response.StatusBadRequest
+	}
 }
@@ -0,0 +1,519 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var dateLine = regexp.MustCompile(`Date: [^\r]*\r\n`)
+
+// roundTrip sends raw to a connection served by a server running handler and
+// returns everything written back until the server closes the connection,
+// with Date headers removed since they change from run to run.
+func roundTrip(t *testing.T, handler Handler, config Config, raw string) string {
+	t.Helper()
+
+	s := newServer(handler, config)
+	client, conn := net.Pipe()
+	go s.handle(conn)
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	go io.WriteString(client, raw)
+
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	client.Close()
+
+	return dateLine.ReplaceAllString(string(out), "")
+}
+
+// startServer serves handler on a local port, for tests of Shutdown and
+// Close, which need a listener.
+func startServer(t *testing.T, handler Handler, config Config) (*Server, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := newServer(handler, config)
+	s.Port = l.Addr().String()
+	s.listener = l
+	go s.listen()
+
+	return s, l.Addr().String()
+}
+
+// dial opens a connection to addr and sends raw on it.
+func dial(t *testing.T, addr string, raw string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.WriteString(conn, raw)
+	require.NoError(t, err)
+
+	return conn
+}
+
+// readResponse reads a single response off a connection that stays open.
+func readResponse(t *testing.T, conn net.Conn) (*http.Response, string) {
+	t.Helper()
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	return res, string(body)
+}
+
+func hello(w *response.Writer, req *request.Request) *HandlerError {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte("hello"))
+	return nil
+}
+
+func TestServerResponses(t *testing.T) {
+	// Test: a buffered body gets a Content-Length
+	out := roundTrip(t, hello, Config{},
+		"GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 5\r\n"+
+		"Connection: close\r\n"+
+		"\r\n"+
+		"hello", out)
+
+	// Test: HEAD runs the same handler, keeping the length but not the body
+	out = roundTrip(t, hello, Config{},
+		"HEAD / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 5\r\n"+
+		"Connection: close\r\n"+
+		"\r\n", out)
+
+	// Test: HEAD keeps an explicit Content-Length too
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("hello"))
+		return nil
+	}, Config{}, "HEAD / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Length: 5\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Connection: close\r\n"+
+		"\r\n", out)
+
+	// Test: 204 drops the body and its framing
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteStatusLine(response.StatusNoContent)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("hello"))
+		return nil
+	}, Config{}, "DELETE /thing HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Connection: close\r\n"+
+		"\r\n", out)
+
+	// Test: 304 drops a chunked body and its framing
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteStatusLine(response.StatusNotModified)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("ETag", `"v1"`)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("hello"))
+		w.WriteChunkedBodyDone()
+		return nil
+	}, Config{}, "GET / HTTP/1.1\r\nHost: a\r\nIf-None-Match: \"v1\"\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\n"+
+		"Etag: \"v1\"\r\n"+
+		"Connection: close\r\n"+
+		"\r\n", out)
+
+	// Test: a streamed body of unknown length is chunked on keep-alive
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte("hel"))
+		w.Flush()
+		w.WriteBody([]byte("lo"))
+		return nil
+	}, Config{}, "GET / HTTP/1.1\r\nHost: a\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n"+
+		"3\r\nhel\r\n2\r\nlo\r\n0\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\n"+
+		"Connection: close\r\n"+
+		"\r\n"+
+		"hello", out)
+
+	// Test: an explicitly chunked body reaches HTTP/1.0 unframed, ended by
+	// closing the connection even though keep-alive was asked for
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("hel"))
+		w.Flush()
+		w.WriteChunkedBody([]byte("lo"))
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(headers.NewHeaders())
+		return nil
+	}, Config{}, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET / HTTP/1.0\r\n\r\n")
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n"+
+		"Connection: close\r\n"+
+		"\r\n"+
+		"hello", out)
+
+	// Test: a handler failing after starting its response gets it aborted
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteBody([]byte("partial"))
+		return &HandlerError{Message: "failed\n", StatusCode: response.StatusInternalServerError}
+	}, Config{}, "GET / HTTP/1.1\r\nHost: a\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	assert.Empty(t, out)
+
+	// Test: so does a streamed response, which is left unterminated
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteBody([]byte("partial"))
+		w.Flush()
+		return &HandlerError{Message: "failed\n", StatusCode: response.StatusInternalServerError}
+	}, Config{}, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n7\r\npartial\r\n"), out)
+
+	// Test: a client asking to close isn't told the connection stays open
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		h := response.GetDefaultHeaders(0)
+		h.Set("Connection", "keep-alive")
+		w.WriteHeaders(h)
+		return nil
+	}, Config{}, "GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "Connection: close\r\n")
+	assert.NotContains(t, out, "keep-alive")
+
+	// Test: the Server header is added when configured
+	out = roundTrip(t, hello, Config{ServerHeader: "httpfromtcp"},
+		"GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "Server: httpfromtcp\r\n")
+}
+
+func TestServerRequests(t *testing.T) {
+	// Test: an unread body is skipped before the next pipelined request
+	out := roundTrip(t, hello, Config{},
+		"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\n\r\nabc"+
+			"GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK"))
+
+	// Test: a malformed request gets a 400 and the connection is closed
+	out = roundTrip(t, hello, Config{}, "GET /\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 400 Bad Request\r\n"+
+		"Content-Length: 40\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Connection: close\r\n"+
+		"\r\n"+
+		"400 Bad Request: malformed request line\n", out)
+
+	// Test: a handler can refuse a body the client is still sending
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		return &HandlerError{Message: "no\n", StatusCode: response.StatusUnauthorized}
+	}, Config{})
+	client, conn := net.Pipe()
+	go s.handle(conn)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	go io.WriteString(client, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1000\r\n\r\nabc")
+	res, body := readResponse(t, client)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equal(t, "no\n", body)
+	client.Close()
+
+	// Test: a body too large to skip closes the connection after the response
+	out = roundTrip(t, hello, Config{},
+		"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1000000\r\n\r\nabc"+
+			"GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200 OK"))
+	assert.Contains(t, out, "Connection: close\r\n")
+
+	// Test: the HTTP/2 connection preface is answered with 505
+	out = roundTrip(t, hello, Config{}, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 505 HTTP Version Not Supported\r\n"), out)
+
+	// Test: methods unknown to the parser reach the handler
+	var method string
+	roundTrip(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		method = req.RequestLine.Method
+		return nil
+	}, Config{}, "PROPFIND / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "PROPFIND", method)
+
+	// Test: a 1.1 request without Host is refused
+	out = roundTrip(t, hello, Config{}, "GET / HTTP/1.1\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 400 Bad Request\r\n")
+
+	// Test: a request without Host is refused before any 100 Continue
+	out = roundTrip(t, hello, Config{},
+		"PUT / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+	assert.NotContains(t, out, "100 Continue")
+
+	// Test: nor is its body buffered before it is refused
+	out = roundTrip(t, hello, Config{BufferBody: true},
+		"PUT / HTTP/1.1\r\nContent-Length: 4\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+
+	// Test: Expect: 100-continue gets an interim response before the body
+	s = newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		body, _ := io.ReadAll(req.BodyReader)
+		w.WriteBody(body)
+		return nil
+	}, Config{})
+	client, conn = net.Pipe()
+	go s.handle(conn)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	go io.WriteString(client, "PUT / HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 4\r\nConnection: close\r\n\r\n")
+	interim := make([]byte, len("HTTP/1.1 100 Continue\r\n\r\n"))
+	_, err := io.ReadFull(client, interim)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", string(interim))
+	go io.WriteString(client, "abcd")
+	rest, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 4\r\n"+
+		"Connection: close\r\n"+
+		"\r\n"+
+		"abcd", dateLine.ReplaceAllString(string(rest), ""))
+
+	// Test: a handler answering without reading the body sends no 100
+	// Continue, and the connection is closed since the body never comes
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		return &HandlerError{Message: "no\n", StatusCode: response.StatusUnauthorized}
+	}, Config{}, "PUT / HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 401 Unauthorized\r\n"), out)
+	assert.NotContains(t, out, "100 Continue")
+	assert.Contains(t, out, "Connection: close\r\n")
+
+	// Test: a buffered body is asked for before the handler runs
+	s = newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteBody(req.Body)
+		return nil
+	}, Config{BufferBody: true})
+	client, conn = net.Pipe()
+	go s.handle(conn)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	go io.WriteString(client, "PUT / HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n")
+	_, err = io.ReadFull(client, interim)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", string(interim))
+	go io.WriteString(client, "abcd")
+	res, body = readResponse(t, client)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "abcd", body)
+	client.Close()
+}
+
+func TestServerTimeouts(t *testing.T) {
+	// Test: a request whose headers arrive too slowly gets a 408
+	out := roundTrip(t, hello, Config{ReadHeaderTimeout: 50 * time.Millisecond},
+		"GET / HTTP/1.1\r\nHost: a\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 408 Request Timeout\r\n"), out)
+	assert.Contains(t, out, "Connection: close\r\n")
+
+	// Test: an idle connection is closed without a response
+	out = roundTrip(t, hello, Config{IdleTimeout: 50 * time.Millisecond}, "")
+	assert.Empty(t, out)
+
+	// Test: a kept-alive connection is closed once idle after its response
+	out = roundTrip(t, hello, Config{IdleTimeout: 50 * time.Millisecond},
+		"GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 5\r\n"+
+		"\r\n"+
+		"hello", out)
+
+	// Test: ReadTimeout interrupts a handler reading a body that stalls
+	var bodyErr error
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		if _, bodyErr = io.ReadAll(req.BodyReader); bodyErr != nil {
+			return &HandlerError{Message: "too slow\n", StatusCode: response.StatusRequestTimeout}
+		}
+		return nil
+	}, Config{ReadTimeout: 50 * time.Millisecond},
+		"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\n\r\nabc")
+	assert.ErrorIs(t, bodyErr, os.ErrDeadlineExceeded)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 408 Request Timeout\r\n"), out)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\ntoo slow\n"), out)
+
+	// Test: WriteTimeout interrupts a response the client doesn't read
+	flushErr := make(chan error, 1)
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteBody([]byte("hello"))
+		flushErr <- w.Flush()
+		return nil
+	}, Config{WriteTimeout: 50 * time.Millisecond})
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.handle(conn)
+	go io.WriteString(client, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	select {
+	case err := <-flushErr:
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(2 * time.Second):
+		t.Fatal("write was not interrupted")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s, addr := startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		if req.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		return hello(w, req)
+	}, Config{})
+
+	idle := dial(t, addr, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	res, body := readResponse(t, idle)
+	assert.Equal(t, "hello", body)
+	assert.False(t, res.Close)
+
+	busy := dial(t, addr, "GET /slow HTTP/1.1\r\nHost: a\r\n\r\n")
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	// Test: an idle connection is closed without waiting
+	_, err := idle.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Shutdown waits for the in-flight request
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned before the in-flight request was answered: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Test: the in-flight request is answered, announcing the close
+	close(release)
+	out, err := io.ReadAll(busy)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(string(out), "\r\n\r\nhello"))
+	require.NoError(t, <-done)
+
+	// Test: no new connections are accepted
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+}
+
+func TestServerForcedClose(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	blocked := func(started chan struct{}) Handler {
+		return func(w *response.Writer, req *request.Request) *HandlerError {
+			close(started)
+			<-release
+			return hello(w, req)
+		}
+	}
+
+	// Test: Shutdown closes the connections still busy when ctx expires
+	started := make(chan struct{})
+	s, addr := startServer(t, blocked(started), Config{})
+	conn := dial(t, addr, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+
+	// Test: Close doesn't wait for in-flight requests at all
+	started = make(chan struct{})
+	s, addr = startServer(t, blocked(started), Config{})
+	conn = dial(t, addr, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	<-started
+	require.NoError(t, s.Close())
+	out, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestServerRequestContext(t *testing.T) {
+	// waitCause is a handler that sends the cause of its request context
+	// being cancelled, once started is closed.
+	waitCause := func(started chan struct{}, cause chan error) Handler {
+		return func(w *response.Writer, req *request.Request) *HandlerError {
+			close(started)
+			<-req.Context().Done()
+			cause <- context.Cause(req.Context())
+			return nil
+		}
+	}
+
+	awaitCause := func(cause chan error) error {
+		select {
+		case err := <-cause:
+			return err
+		case <-time.After(2 * time.Second):
+			t.Fatal("request context was not cancelled")
+			return nil
+		}
+	}
+
+	// Test: the context is cancelled when the client goes away
+	started, cause := make(chan struct{}), make(chan error, 1)
+	s := newServer(waitCause(started, cause), Config{})
+	client, conn := net.Pipe()
+	go s.handle(conn)
+	go io.WriteString(client, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	<-started
+	client.Close()
+	assert.ErrorIs(t, awaitCause(cause), ErrClientDisconnected)
+
+	// Test: the context is cancelled when the handler runs out of time
+	started, cause = make(chan struct{}), make(chan error, 1)
+	roundTrip(t, waitCause(started, cause), Config{WriteTimeout: 50 * time.Millisecond},
+		"GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	assert.ErrorIs(t, awaitCause(cause), ErrHandlerTimeout)
+
+	// Test: the context is cancelled when the server shuts down
+	started, cause = make(chan struct{}), make(chan error, 1)
+	s, addr := startServer(t, waitCause(started, cause), Config{})
+	dial(t, addr, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	<-started
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	assert.ErrorIs(t, awaitCause(cause), ErrServerClosed)
+	require.NoError(t, <-done)
+}